@@ -0,0 +1,71 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the source of time used by the Waiter. The default clock uses the
+// time package functions. A fake clock may be used in tests to make the time
+// run instantly, see NewWithClock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock which uses the time package functions.
+type realClock struct{}
+
+// Now returns the current local time.
+func (realClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time on
+// the returned channel.
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// NewWithClock creates a new Waiter object which uses the specified clock.
+//
+// The function is similar to New, but the Waiter gets the current time and
+// sleeps between calls with the clock. This is useful to test the rate
+// limited code without real waiting.
+func NewWithClock(clock Clock, delay time.Duration, queueLen int) *Waiter {
+	w := newWaiter(context.Background(), delay, queueLen)
+	w.clock = clock
+	w.last = clock.Now()
+	w.start()
+	return w
+}
+
+// sleep pauses the current goroutine for at least the duration d using the
+// Waiter clock, and adds d to the total waited time. The sleep is interrupted
+// when the worker is stopped by Close, and only the time slept is added then.
+func (w *Waiter) sleep(d time.Duration) {
+	w.sleepOr(d, nil)
+}
+
+// sleepOr sleeps the same as sleep, but it is also interrupted when the wake
+// channel is closed. It returns false if the sleep was interrupted.
+func (w *Waiter) sleepOr(d time.Duration, wake <-chan struct{}) bool {
+	w.mu.Lock()
+	halt := w.halt
+	w.mu.Unlock()
+
+	start := w.clock.Now()
+	select {
+	case <-w.clock.After(d):
+		w.stats.waited.Add(int64(d))
+		return true
+	case <-halt:
+	case <-wake:
+	}
+	w.stats.waited.Add(int64(min(w.clock.Now().Sub(start), d)))
+	return false
+}
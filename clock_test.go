@@ -0,0 +1,68 @@
+package waiter
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock which advances its time instantly when After is
+// called.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestNewWithClock(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	start := clock.Now()
+	w := NewWithClock(clock, time.Hour, 10)
+	defer w.Close()
+
+	// The calls are executed without real waiting
+	realStart := time.Now()
+	for range 3 {
+		w.Wait(nil)
+	}
+	if elapsed := time.Since(realStart); elapsed > time.Second {
+		t.Errorf("real elapsed=%v, want < 1s", elapsed)
+	}
+
+	// The clock time advances by the delay between calls
+	if elapsed := clock.Now().Sub(start); elapsed < 3*time.Hour {
+		t.Errorf("clock elapsed=%v, want >= 3h", elapsed)
+	}
+}
+
+func TestStopAtWithClock(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	w := NewWithClock(clock, time.Millisecond, 10)
+
+	// The deadline is waited with the fake clock, not in real time
+	deadline := clock.Now().Add(2 * time.Hour)
+	w.StopAt(deadline)
+	select {
+	case <-w.Done():
+	case <-time.After(time.Second):
+		t.Fatal("waiter is not closed at the fake clock deadline")
+	}
+	if now := clock.Now(); now.Before(deadline) {
+		t.Errorf("clock=%v, want after the deadline %v", now, deadline)
+	}
+}
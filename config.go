@@ -0,0 +1,93 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Config is the Waiter configuration, which may be unmarshalled from JSON and
+// passed to NewFromConfig. In JSON the delay may be a duration string, like
+// "100ms", or a number of nanoseconds:
+//
+//	{"delay": "100ms", "queueLen": 10, "jitter": 0.1, "burst": 5}
+type Config struct {
+	// Delay is the time to wait between calls.
+	Delay time.Duration `json:"delay"`
+
+	// QueueLen is the length of the queue of functions to call.
+	QueueLen int `json:"queueLen"`
+
+	// Jitter is the fraction of the delay used to randomize the time to wait
+	// between calls, in the range [0, 1]. See Waiter.SetJitter.
+	Jitter float64 `json:"jitter"`
+
+	// Burst is the number of calls which may be executed without delay. See
+	// NewBurst.
+	Burst int `json:"burst"`
+}
+
+// UnmarshalJSON unmarshals the configuration from JSON, accepting the delay
+// as a duration string or a number of nanoseconds.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	aux := struct {
+		*config
+		Delay json.RawMessage `json:"delay"`
+	}{config: (*config)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.Delay) == 0 {
+		return nil
+	}
+
+	// Parse the duration string
+	var s string
+	if err := json.Unmarshal(aux.Delay, &s); err == nil {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+		c.Delay = d
+		return nil
+	}
+
+	// Parse the number of nanoseconds
+	var ns int64
+	if err := json.Unmarshal(aux.Delay, &ns); err != nil {
+		return fmt.Errorf("%w: delay must be a duration string or a number",
+			ErrInvalidConfig)
+	}
+	c.Delay = time.Duration(ns)
+	return nil
+}
+
+// NewFromConfig creates a new Waiter object with the specified configuration.
+//
+// The configuration is validated first: the delay, queue length and burst
+// must not be negative and the jitter must be in the range [0, 1]. If the
+// configuration is invalid, NewFromConfig returns an error wrapping
+// ErrInvalidConfig.
+func NewFromConfig(cfg Config) (*Waiter, error) {
+	switch {
+	case cfg.Delay < 0:
+		return nil, fmt.Errorf("%w: negative delay", ErrInvalidConfig)
+	case cfg.QueueLen < 0:
+		return nil, fmt.Errorf("%w: negative queue length", ErrInvalidConfig)
+	case cfg.Jitter < 0 || cfg.Jitter > 1:
+		return nil, fmt.Errorf("%w: jitter out of range [0, 1]", ErrInvalidConfig)
+	case cfg.Burst < 0:
+		return nil, fmt.Errorf("%w: negative burst", ErrInvalidConfig)
+	}
+
+	opts := []Option{WithQueueLen(cfg.QueueLen), WithJitter(cfg.Jitter)}
+	if cfg.Burst > 1 {
+		opts = append(opts, WithBurst(cfg.Burst))
+	}
+	return NewWithOptions(cfg.Delay, opts...), nil
+}
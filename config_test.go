@@ -0,0 +1,58 @@
+package waiter
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConfigUnmarshalJSON(t *testing.T) {
+	var cfg Config
+	data := `{"delay": "100ms", "queueLen": 10, "jitter": 0.1, "burst": 5}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	want := Config{Delay: 100 * time.Millisecond, QueueLen: 10, Jitter: 0.1, Burst: 5}
+	if cfg != want {
+		t.Errorf("config=%+v, want %+v", cfg, want)
+	}
+
+	// The delay may be a number of nanoseconds
+	if err := json.Unmarshal([]byte(`{"delay": 1000}`), &cfg); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if cfg.Delay != time.Microsecond {
+		t.Errorf("delay=%v, want 1µs", cfg.Delay)
+	}
+
+	// The invalid delay is an error
+	for _, data := range []string{`{"delay": "fast"}`, `{"delay": true}`} {
+		if err := json.Unmarshal([]byte(data), &cfg); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: err=%v, want %v", data, err, ErrInvalidConfig)
+		}
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	w, err := NewFromConfig(Config{Delay: 10 * time.Millisecond, QueueLen: 5, Burst: 3})
+	if err != nil {
+		t.Fatalf("new error: %v", err)
+	}
+	defer w.Close()
+	if w.Delay() != 10*time.Millisecond || w.Cap() != 5 || w.burst != 3 {
+		t.Errorf("waiter=%v, burst=%d, want 10ms delay, cap 5, burst 3", w, w.burst)
+	}
+
+	// The invalid configs are rejected
+	for _, cfg := range []Config{
+		{Delay: -time.Second},
+		{QueueLen: -1},
+		{Jitter: 2},
+		{Burst: -1},
+	} {
+		if _, err := NewFromConfig(cfg); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("config=%+v: err=%v, want %v", cfg, err, ErrInvalidConfig)
+		}
+	}
+}
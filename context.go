@@ -0,0 +1,26 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import "context"
+
+// contextKey is the private type of the context key of the Waiter, so it
+// does not collide with the keys defined in other packages.
+type contextKey struct{}
+
+// NewContext returns a copy of the parent context which carries the Waiter w.
+//
+// It allows the request scoped code to get the Waiter with FromContext
+// instead of passing it explicitly through the call chain.
+func NewContext(ctx context.Context, w *Waiter) context.Context {
+	return context.WithValue(ctx, contextKey{}, w)
+}
+
+// FromContext returns the Waiter carried by the context, see NewContext. It
+// returns false if the context has no Waiter.
+func FromContext(ctx context.Context) (w *Waiter, ok bool) {
+	w, ok = ctx.Value(contextKey{}).(*Waiter)
+	return
+}
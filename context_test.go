@@ -0,0 +1,32 @@
+package waiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContext(t *testing.T) {
+	w := New(time.Millisecond, 1)
+	defer w.Close()
+
+	ctx := NewContext(context.Background(), w)
+	got, ok := FromContext(ctx)
+	if !ok || got != w {
+		t.Errorf("waiter=%p ok=%t, want %p true", got, ok, w)
+	}
+
+	// The child context carries the same Waiter
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if got, _ := FromContext(child); got != w {
+		t.Errorf("child waiter=%p, want %p", got, w)
+	}
+}
+
+func TestContextMissing(t *testing.T) {
+	w, ok := FromContext(context.Background())
+	if ok || w != nil {
+		t.Errorf("waiter=%p ok=%t, want nil false", w, ok)
+	}
+}
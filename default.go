@@ -0,0 +1,64 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Default Waiter settings: 10 calls per second and a queue of 100 functions.
+const (
+	defaultDelay    = 100 * time.Millisecond
+	defaultQueueLen = 100
+)
+
+var (
+	// defaultOnce creates the default Waiter once.
+	defaultOnce sync.Once
+
+	// defaultMu protects defaultWaiter.
+	defaultMu sync.Mutex
+
+	// defaultWaiter is the shared Waiter returned by Default.
+	defaultWaiter *Waiter
+)
+
+// Default returns the shared default Waiter, which is created on the first
+// call with the delay of 100ms and the queue length of 100.
+//
+// The default Waiter is a convenience for simple programs, like
+// http.DefaultClient, so they don't have to pass a Waiter everywhere. It may
+// be replaced with SetDefault. The programs which call different APIs or use
+// the Waiter heavily should create their own Waiters.
+func Default() *Waiter {
+	defaultOnce.Do(func() {
+		defaultMu.Lock()
+		defer defaultMu.Unlock()
+		if defaultWaiter == nil {
+			defaultWaiter = New(defaultDelay, defaultQueueLen)
+		}
+	})
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultWaiter
+}
+
+// SetDefault replaces the shared default Waiter returned by Default. The
+// previous default Waiter is not closed.
+func SetDefault(w *Waiter) {
+	defaultOnce.Do(func() {})
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultWaiter = w
+}
+
+// Do calls the specified function with the default Waiter, see Default and
+// Waiter.Call.
+func Do(fn func()) error {
+	return Default().Call(fn)
+}
@@ -0,0 +1,32 @@
+package waiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefault(t *testing.T) {
+	w := Default()
+	if w != Default() {
+		t.Error("default waiter is created twice")
+	}
+	if d := w.Delay(); d != defaultDelay {
+		t.Errorf("delay=%v, want %v", d, defaultDelay)
+	}
+
+	// Do calls the function with the default Waiter
+	called := make(chan struct{})
+	if err := Do(func() { close(called) }); err != nil {
+		t.Fatalf("do error: %v", err)
+	}
+	<-called
+
+	// SetDefault replaces the default Waiter
+	w2 := New(time.Millisecond, 1)
+	SetDefault(w2)
+	defer SetDefault(w)
+	defer w2.Close()
+	if Default() != w2 {
+		t.Error("default waiter is not replaced")
+	}
+}
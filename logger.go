@@ -0,0 +1,39 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+// Logger is the interface used by the Waiter to log its state changes: close,
+// rejected functions and recovered panics. The log.Logger satisfies it, and
+// the adapters for other logging packages are trivial. The default logger
+// does not print anything, see SetLogger.
+type Logger interface {
+	// Printf prints the message in the manner of fmt.Printf.
+	Printf(format string, args ...any)
+}
+
+// nopLogger is the Logger which does not print anything.
+type nopLogger struct{}
+
+// Printf does nothing.
+func (nopLogger) Printf(format string, args ...any) {}
+
+// SetLogger sets the logger used to log the Waiter state changes. If l is
+// nil, the Waiter does not log anything.
+func (w *Waiter) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.logger = l
+}
+
+// logf prints the message with the Waiter logger.
+func (w *Waiter) logf(format string, args ...any) {
+	w.mu.Lock()
+	l := w.logger
+	w.mu.Unlock()
+	l.Printf(format, args...)
+}
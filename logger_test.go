@@ -0,0 +1,42 @@
+package waiter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger is the Logger which saves the messages.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Printf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func TestSetLogger(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	l := &testLogger{}
+	w.SetLogger(l)
+	w.SetPanicHandler(func(any) {})
+
+	w.Call(func() { panic("test") })
+	w.Flush()
+	w.Close()
+	w.Call(func() {})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	log := strings.Join(l.msgs, "\n")
+	for _, want := range []string{"panic: test", "closed", "rejected"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log %q does not contain %q", log, want)
+		}
+	}
+}
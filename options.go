@@ -0,0 +1,76 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"context"
+	"time"
+)
+
+// Option configures the Waiter created with NewWithOptions.
+type Option func(w *Waiter)
+
+// NewWithOptions creates a new Waiter object configured with the specified
+// options.
+//
+// The function is similar to New, but the Waiter settings are passed as
+// options, so new settings may be added without new constructors. Without
+// options the Waiter has an unbuffered queue and the defaults described in
+// each option.
+func NewWithOptions(delay time.Duration, opts ...Option) *Waiter {
+	w := newWaiter(context.Background(), delay, 0)
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.start()
+	return w
+}
+
+// WithQueueLen sets the length of the queue of functions to call, as the
+// queueLen argument of New. The default is 0, the unbuffered queue. The
+// negative length is treated as zero.
+func WithQueueLen(n int) Option {
+	return func(w *Waiter) { w.q.size = max(n, 0) }
+}
+
+// WithContext binds the Waiter lifecycle to the context, as NewWithContext.
+// The default is context.Background, so the Waiter is closed by Close only.
+func WithContext(ctx context.Context) Option {
+	return func(w *Waiter) { w.ctx = ctx }
+}
+
+// WithPolicy sets the queue overflow policy, as NewWithPolicy. The default is
+// Block.
+func WithPolicy(policy OverflowPolicy) Option {
+	return func(w *Waiter) { w.q.policy = policy }
+}
+
+// WithBurst allows bursts of calls in token bucket mode, as NewBurst. The
+// default is no bursts.
+func WithBurst(burst int) Option {
+	return func(w *Waiter) {
+		w.burst = burst
+		w.tokens = float64(burst)
+	}
+}
+
+// WithJitter sets the fraction of the delay used to randomize the time to
+// wait between calls, as SetJitter. The default is 0, no jitter.
+func WithJitter(fraction float64) Option {
+	return func(w *Waiter) { w.SetJitter(fraction) }
+}
+
+// WithLogger sets the logger of the Waiter state changes, as SetLogger. The
+// default logger does not print anything.
+func WithLogger(l Logger) Option {
+	return func(w *Waiter) { w.SetLogger(l) }
+}
+
+// WithPanicHandler sets the function to call when a scheduled function
+// panics, as SetPanicHandler. By default the panic value is printed to
+// stderr.
+func WithPanicHandler(h func(any)) Option {
+	return func(w *Waiter) { w.SetPanicHandler(h) }
+}
@@ -0,0 +1,49 @@
+package waiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &testLogger{}
+	var panicked any
+	w := NewWithOptions(10*time.Millisecond,
+		WithQueueLen(5),
+		WithContext(ctx),
+		WithPolicy(DropNewest),
+		WithJitter(0.5),
+		WithLogger(l),
+		WithPanicHandler(func(r any) { panicked = r }),
+	)
+
+	if c := w.Cap(); c != 5 {
+		t.Errorf("cap=%d, want 5", c)
+	}
+	w.Call(func() { panic("test") })
+	w.Flush()
+	if panicked != "test" {
+		t.Errorf("panicked=%v, want test", panicked)
+	}
+
+	// The context closes the Waiter
+	cancel()
+	<-w.stopped
+	if !w.Closed() {
+		t.Error("waiter is not closed by the context")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.msgs) == 0 {
+		t.Error("logger is not set")
+	}
+
+	// Without options the queue is unbuffered
+	w = NewWithOptions(time.Millisecond)
+	defer w.Close()
+	if c := w.Cap(); c != 0 {
+		t.Errorf("cap=%d, want 0", c)
+	}
+}
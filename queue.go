@@ -0,0 +1,303 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"container/heap"
+	"slices"
+	"sync"
+)
+
+// queue is a bounded priority queue of tasks. It works like a buffered
+// channel, but its capacity may be changed while the queue is used, and the
+// tasks with higher priority are popped first. The tasks with the same
+// priority are popped round robin across the task groups, and in FIFO order
+// within a group.
+type queue struct {
+	// mu protects all the queue fields.
+	mu sync.Mutex
+
+	// tasks is the heap of queued tasks.
+	tasks taskHeap
+
+	// seq is the sequence number of the last pushed task.
+	seq uint64
+
+	// rounds is the round of the last pushed task of each group.
+	rounds map[string]uint64
+
+	// round is the highest round of the popped tasks.
+	round uint64
+
+	// size is the capacity of the queue.
+	size int
+
+	// policy defines what push does when the queue is full.
+	policy OverflowPolicy
+
+	// waiting is the number of goroutines waiting in pop. A task may be
+	// pushed to a full queue if there is a goroutine waiting for it, the same
+	// as a send to an unbuffered channel.
+	waiting int
+
+	// closed is a flag to indicate if the queue is closed.
+	closed bool
+
+	// changed is closed and replaced when the queue changes, to wake up the
+	// goroutines waiting in push and pop.
+	changed chan struct{}
+}
+
+// nowait is a closed channel passed to push to add a task without waiting.
+var nowait = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// newQueue creates a new queue with the specified capacity.
+func newQueue(size int) *queue {
+	return &queue{
+		size:    size,
+		rounds:  make(map[string]uint64),
+		changed: make(chan struct{}),
+	}
+}
+
+// push adds the task to the queue. If the queue is full push waits until
+// there is room for the task or the done channel is closed, and returns
+// ErrQueueFull in the latter case. Use the nil done channel to wait forever,
+// or the nowait channel to return without waiting. If the queue is closed
+// push returns ErrWaiterClosed.
+//
+// If the queue overflow policy is not Block, push never waits. With the
+// DropNewest policy it returns ErrQueueFull if the queue is full. With the
+// DropOldest policy it removes the first task from the full queue to make room
+// for the new task, and returns the removed task in dropped.
+func (q *queue) push(t task, done <-chan struct{}) (dropped []task, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		full := len(q.tasks)-q.waiting >= q.size
+		switch {
+		case q.closed:
+			return nil, ErrWaiterClosed
+		case full && q.policy == DropOldest && len(q.tasks) > 0:
+			dropped = append(dropped, heap.Pop(&q.tasks).(task))
+			fallthrough
+		case !full:
+			q.seq++
+			t.seq = q.seq
+			t.round = max(q.rounds[t.group], q.round) + t.step()
+			q.rounds[t.group] = t.round
+			if t.position != nil {
+				*t.position = q.ahead(t)
+			}
+			heap.Push(&q.tasks, t)
+			q.notify()
+			return
+		case q.policy != Block:
+			return nil, ErrQueueFull
+		}
+
+		// Wait until the queue changes or done is closed
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+			q.mu.Lock()
+		case <-done:
+			q.mu.Lock()
+			return nil, ErrQueueFull
+		}
+	}
+}
+
+// pop removes the first task from the queue and returns it. If the queue is
+// empty pop waits until a task is pushed. It returns false if the queue is
+// closed and empty, or if the done channel is closed.
+func (q *queue) pop(done <-chan struct{}) (t task, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.tasks) == 0 {
+		if q.closed {
+			return
+		}
+
+		// Wait until the queue changes or done is closed
+		q.waiting++
+		q.notify()
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-done:
+		}
+		q.mu.Lock()
+		q.waiting--
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+
+	// Remove the first task and forget the groups which have no tasks after
+	// its round
+	t, ok = heap.Pop(&q.tasks).(task), true
+	q.round = max(q.round, t.round)
+	if q.rounds[t.group] <= q.round {
+		delete(q.rounds, t.group)
+	}
+	q.notify()
+	return
+}
+
+// drain removes all the tasks from the queue and returns them in the order
+// they would be popped.
+func (q *queue) drain() (tasks []task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.drainLocked()
+}
+
+// closeAndDrain closes the queue and removes all the tasks from it, so no
+// task may be popped after this call.
+func (q *queue) closeAndDrain() (tasks []task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	return q.drainLocked()
+}
+
+// drainLocked removes all the tasks from the queue and returns them in the
+// order they would be popped. It must be called with mu locked.
+func (q *queue) drainLocked() (tasks []task) {
+	tasks, q.tasks = q.tasks, nil
+	clear(q.rounds)
+	sortTasks(tasks)
+	q.notify()
+	return
+}
+
+// labels returns the labels of the queued tasks in the order they would be
+// popped.
+func (q *queue) labels() (labels []string) {
+	q.mu.Lock()
+	tasks := slices.Clone(q.tasks)
+	q.mu.Unlock()
+
+	sortTasks(tasks)
+	labels = make([]string, len(tasks))
+	for i, t := range tasks {
+		labels[i] = t.label
+	}
+	return
+}
+
+// sortTasks sorts the tasks in the order they would be popped.
+func sortTasks(tasks []task) {
+	slices.SortFunc(tasks, func(a, b task) int {
+		switch {
+		case a.before(b):
+			return -1
+		case b.before(a):
+			return 1
+		}
+		return 0
+	})
+}
+
+// ahead returns the number of the queued tasks which are popped before the
+// task t. It must be called with mu locked.
+func (q *queue) ahead(t task) (n int) {
+	for _, u := range q.tasks {
+		if u.before(t) {
+			n++
+		}
+	}
+	return
+}
+
+// close closes the queue. The closed queue does not accept new tasks, but the
+// queued tasks may still be popped.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notify()
+}
+
+// open opens the closed queue again.
+func (q *queue) open() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = false
+	q.notify()
+}
+
+// resize changes the capacity of the queue. It returns ErrQueueTooShort if
+// the queue has more tasks than the new capacity.
+func (q *queue) resize(size int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if size < len(q.tasks) {
+		return ErrQueueTooShort
+	}
+	q.size = size
+	q.notify()
+	return nil
+}
+
+// len returns the number of tasks in the queue.
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// full returns true if the queue has no room for a new task.
+func (q *queue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)-q.waiting >= q.size
+}
+
+// cap returns the capacity of the queue.
+func (q *queue) cap() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// notify wakes up the goroutines waiting for the queue changes. It must be
+// called with mu locked.
+func (q *queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// taskHeap implements heap.Interface for the queued tasks.
+type taskHeap []task
+
+func (h taskHeap) Len() int           { return len(h) }
+func (h taskHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h taskHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *taskHeap) Push(x any)        { *h = append(*h, x.(task)) }
+
+func (h *taskHeap) Pop() any {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = task{}
+	*h = old[:n-1]
+	return t
+}
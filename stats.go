@@ -0,0 +1,223 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindow is the number of the last calls used to measure the rate, see
+// Waiter.Rate.
+const rateWindow = 16
+
+// Stats is a snapshot of the Waiter counters returned by the Waiter.Stats
+// function. It is a plain value, so it is safe to read and pass it between
+// goroutines.
+type Stats struct {
+	// Scheduled is the total number of functions added to the queue.
+	Scheduled uint64
+
+	// Executed is the total number of functions called by the Waiter.
+	Executed uint64
+
+	// Rejected is the total number of functions rejected because the Waiter
+	// is closed, or dropped from the full queue by the DropOldest policy.
+	Rejected uint64
+
+	// Queued is the number of functions currently waiting in the queue.
+	Queued int
+}
+
+// stats contains the Waiter counters updated by the Waiter functions.
+type stats struct {
+	scheduled atomic.Uint64
+	executed  atomic.Uint64
+	rejected  atomic.Uint64
+
+	// waited is the total time the Waiter slept to honor the delay.
+	waited atomic.Int64
+
+	// maxLen is the maximum length of the queue.
+	maxLen atomic.Int64
+
+	// mu protects the call times.
+	mu sync.Mutex
+
+	// calls is the ring buffer of the last call times.
+	calls [rateWindow]time.Time
+
+	// ncalls is the total number of call times added to calls.
+	ncalls int
+}
+
+// addCall adds the call time to the ring buffer of the last call times.
+func (s *stats) addCall(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[s.ncalls%rateWindow] = t
+	s.ncalls++
+}
+
+// addLen updates the maximum length of the queue with the length n. It
+// returns true if n is the new maximum.
+func (s *stats) addLen(n int) bool {
+	for {
+		m := s.maxLen.Load()
+		if int64(n) <= m {
+			return false
+		}
+		if s.maxLen.CompareAndSwap(m, int64(n)) {
+			return true
+		}
+	}
+}
+
+// rate returns the number of calls per second over the last call times.
+func (s *stats) rate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := min(s.ncalls, rateWindow)
+	if n < 2 {
+		return 0
+	}
+	first := s.calls[(s.ncalls-n)%rateWindow]
+	last := s.calls[(s.ncalls-1)%rateWindow]
+	d := last.Sub(first)
+	if d <= 0 {
+		return 0
+	}
+	return float64(n-1) / d.Seconds()
+}
+
+// Stats returns a snapshot of the Waiter counters.
+func (w *Waiter) Stats() Stats {
+	return Stats{
+		Scheduled: w.stats.scheduled.Load(),
+		Executed:  w.stats.executed.Load(),
+		Rejected:  w.stats.rejected.Load(),
+		Queued:    w.Len(),
+	}
+}
+
+// gaps returns the gaps between the last call times, oldest first.
+func (s *stats) gaps() (gaps []time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := min(s.ncalls, rateWindow)
+	for i := s.ncalls - n + 1; i < s.ncalls; i++ {
+		gaps = append(gaps, s.calls[i%rateWindow].Sub(s.calls[(i-1)%rateWindow]))
+	}
+	return
+}
+
+// Rate returns the observed number of calls per second over the last 16
+// calls.
+//
+// Rate may be compared with the configured rate to check the Waiter performs
+// as expected: the lower rate means the queue is starved. It returns 0 until
+// at least two functions are called.
+func (w *Waiter) Rate() float64 {
+	return w.stats.rate()
+}
+
+// TotalWaited returns the total time the Waiter slept to honor the delay since
+// it was created.
+//
+// It shows how much latency the rate limit added to the calls, which helps to
+// decide whether a higher quota is required.
+func (w *Waiter) TotalWaited() time.Duration {
+	return time.Duration(w.stats.waited.Load())
+}
+
+// MaxLen returns the maximum number of functions waiting in the queue at the
+// same time since the Waiter was created.
+//
+// The maximum helps to size the queue length by the observed load instead of
+// guesswork. See SetOnHighWater to be notified when it grows.
+func (w *Waiter) MaxLen() int {
+	return int(w.stats.maxLen.Load())
+}
+
+// GapHistogram returns the gaps between the last 16 calls, oldest first.
+//
+// The gaps show the actual spacing of the calls, for example to prove the
+// Waiter never exceeded the rate limit of the API provider. It returns nil
+// until at least two functions are called.
+func (w *Waiter) GapHistogram() []time.Duration {
+	return w.stats.gaps()
+}
+
+// StartMetricsReporter calls the sink function with the Stats snapshot every
+// interval, until the returned stop function is called or the Waiter is
+// closed. A non-positive interval starts no reporter and returns the stop
+// function which does nothing.
+//
+// The sink is called in a separate goroutine, which exits after stop or
+// Close, so the reporter does not leak. The stop function waits for the
+// goroutine to exit, so the sink is not running and is not called after stop
+// returns. The stop function may be called many times, and from the sink
+// itself: then it does not wait, and the reporter exits after the sink
+// returns.
+func (w *Waiter) StartMetricsReporter(interval time.Duration, sink func(Stats)) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	var once sync.Once
+	halt := make(chan struct{})
+	exited := make(chan struct{})
+	started := make(chan uint64, 1)
+	done := w.Done()
+	go func() {
+		defer close(exited)
+		started <- goroutineID()
+		for {
+			select {
+			case <-w.clock.After(interval):
+			case <-halt:
+				return
+			case <-done:
+				return
+			}
+
+			// Do not call the sink after stop
+			select {
+			case <-halt:
+				return
+			default:
+			}
+			sink(w.Stats())
+		}
+	}()
+	reporter := <-started
+	return func() {
+		once.Do(func() { close(halt) })
+		if goroutineID() != reporter {
+			<-exited
+		}
+	}
+}
+
+// goroutineID returns the id of the calling goroutine. It is used to tell
+// the stop function called from the sink, which must not wait for the
+// reporter goroutine calling the sink, see StartMetricsReporter.
+func goroutineID() uint64 {
+	// The stack trace starts with "goroutine <id> ["
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
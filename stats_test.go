@@ -0,0 +1,199 @@
+package waiter
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	for range 3 {
+		w.Wait(nil)
+	}
+	w.CloseAndWait()
+	w.Call(func() {})
+
+	stats := w.Stats()
+	if stats.Scheduled != 3 || stats.Executed != 3 || stats.Rejected != 1 {
+		t.Errorf("stats=%+v, want 3 scheduled, 3 executed, 1 rejected", stats)
+	}
+}
+
+func TestRate(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	if r := w.Rate(); r != 0 {
+		t.Errorf("rate=%v before calls, want 0", r)
+	}
+
+	// The observed rate is close to 100 calls per second
+	for range 10 {
+		w.Call(func() {})
+	}
+	w.Flush()
+	if r := w.Rate(); r < 70 || r > 110 {
+		t.Errorf("rate=%v, want about 100", r)
+	}
+}
+
+func TestTotalWaited(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	// Each call waits about the delay
+	for range 4 {
+		w.Call(func() {})
+	}
+	w.Flush()
+	if d := w.TotalWaited(); d < 3*delay || d > 4*delay {
+		t.Errorf("waited=%v, want about %v", d, 4*delay)
+	}
+}
+
+func TestGapHistogram(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	w := New(delay, 20)
+	defer w.Close()
+
+	if gaps := w.GapHistogram(); gaps != nil {
+		t.Errorf("gaps=%v before calls, want nil", gaps)
+	}
+
+	// The mean gap is close to the delay
+	for range 20 {
+		w.Call(func() {})
+	}
+	w.Flush()
+	gaps := w.GapHistogram()
+	if len(gaps) != rateWindow-1 {
+		t.Fatalf("gaps=%d, want %d", len(gaps), rateWindow-1)
+	}
+	var sum time.Duration
+	for _, gap := range gaps {
+		sum += gap
+	}
+	if mean := sum / time.Duration(len(gaps)); mean < delay*9/10 || mean > delay*3/2 {
+		t.Errorf("mean gap=%v, want about %v", mean, delay)
+	}
+}
+
+func TestMaxLen(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	var depths []int
+	w.SetOnHighWater(func(depth int) { depths = append(depths, depth) })
+
+	// The first function waits the delay in the worker, the burst is queued
+	w.Call(func() {})
+	time.Sleep(10 * time.Millisecond)
+	for range 5 {
+		w.Call(func() {})
+	}
+	if n := w.MaxLen(); n != 5 {
+		t.Errorf("max len=%d, want 5", n)
+	}
+
+	// The handler is called for each new maximum
+	if !slices.IsSorted(depths) || len(depths) == 0 || depths[len(depths)-1] != 5 {
+		t.Errorf("depths=%v, want increasing up to 5", depths)
+	}
+	n := len(depths)
+	w.Call(func() {})
+	w.Call(func() {})
+	if len(depths) != n+2 || w.MaxLen() != 7 {
+		t.Errorf("depths=%v max len=%d, want up to 7", depths, w.MaxLen())
+	}
+}
+
+func TestStartMetricsReporter(t *testing.T) {
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+
+	// The sink is called every interval until stop
+	var reports atomic.Int32
+	stop := w.StartMetricsReporter(20*time.Millisecond, func(Stats) {
+		reports.Add(1)
+	})
+	time.Sleep(110 * time.Millisecond)
+	stop()
+	stop()
+	if n := reports.Load(); n < 3 || n > 6 {
+		t.Errorf("reports=%d, want about 5", n)
+	}
+	n := reports.Load()
+	time.Sleep(50 * time.Millisecond)
+	if m := reports.Load(); m != n {
+		t.Errorf("reports=%d after stop, want %d", m, n)
+	}
+
+	// The stop may be called from the sink
+	stopped := make(chan struct{})
+	var stopSelf func()
+	ready := make(chan struct{})
+	stopSelf = w.StartMetricsReporter(10*time.Millisecond, func(Stats) {
+		<-ready
+		stopSelf()
+		close(stopped)
+	})
+	close(ready)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop called from the sink blocks")
+	}
+
+	// The stop called while the sink runs waits for the sink to return
+	entered, release := make(chan struct{}), make(chan struct{})
+	var finished atomic.Bool
+	var once sync.Once
+	stop = w.StartMetricsReporter(10*time.Millisecond, func(Stats) {
+		once.Do(func() { close(entered) })
+		<-release
+		finished.Store(true)
+	})
+	<-entered
+	stopped = make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returns while the sink runs")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-stopped:
+		if !finished.Load() {
+			t.Error("stop returns before the sink returns")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stop is not released after the sink returns")
+	}
+
+	// The non-positive interval starts no reporter
+	var zero atomic.Int32
+	w.StartMetricsReporter(0, func(Stats) { zero.Add(1) })()
+	time.Sleep(20 * time.Millisecond)
+	if m := zero.Load(); m != 0 {
+		t.Errorf("reports=%d with zero interval, want 0", m)
+	}
+
+	// The reporter stops when the Waiter is closed
+	var closed atomic.Int32
+	w2 := New(time.Millisecond, 10)
+	w2.StartMetricsReporter(10*time.Millisecond, func(Stats) { closed.Add(1) })
+	w2.Close()
+	time.Sleep(50 * time.Millisecond)
+	if m := closed.Load(); m > 1 {
+		t.Errorf("reports=%d after close, want at most 1", m)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2025 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import "net/http"
+
+// roundTripper is the http.RoundTripper which sends the requests with the
+// Waiter rate limit.
+type roundTripper struct {
+	w    *Waiter
+	next http.RoundTripper
+}
+
+// RoundTripper returns the http.RoundTripper which waits the Waiter delay
+// before sending each request with the next RoundTripper. If next is nil,
+// http.DefaultTransport is used.
+//
+// Use it as the http.Client transport to rate limit all the client requests:
+//
+//	client := &http.Client{Transport: w.RoundTripper(nil)}
+//
+// The request waits its turn in the Waiter queue, and then it is sent in the
+// goroutine of the caller, so the requests are started with the delay but
+// may run concurrently. If the request context is done while the request
+// waits in the queue, RoundTrip returns the context error. If the Waiter is
+// closed, it returns ErrWaiterClosed.
+func (w *Waiter) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &roundTripper{w: w, next: next}
+}
+
+// RoundTrip waits the Waiter delay and sends the request with the next
+// RoundTripper.
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := rt.w.WaitContext(req.Context(), nil); err != nil {
+		return nil, err
+	}
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,48 @@
+package waiter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoundTripper(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	w := New(delay, 10)
+	client := &http.Client{Transport: w.RoundTripper(nil)}
+
+	// The requests are sent with the delay
+	w.Reset()
+	start := time.Now()
+	for range 3 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("get error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("elapsed=%v, want at least %v", elapsed, 2*delay)
+	}
+
+	// The request context cancels the waiting request
+	w.SetDelay(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err=%v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The closed Waiter rejects the requests
+	w.Close()
+	if _, err := client.Get(srv.URL); !errors.Is(err, ErrWaiterClosed) {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
@@ -12,28 +12,432 @@
 package waiter
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
-var ErrWaiterClosed = fmt.Errorf("waiter is closed")
+// Waiter errors.
+//
+// ErrWaiterClosed is returned when the Waiter was closed and does not accept
+// new functions any more. This is a permanent state.
+//
+// ErrQueueFull is returned by non-blocking calls when the Waiter is open but
+// its queue has no room for a new function at the moment. This is a temporary
+// state: the same call may succeed later when the queue is drained.
+//
+// ErrTimeout is returned by WaitTimeout when the function was not called
+// within the timeout. The function is cancelled and will not be called.
+//
+// ErrQueueTooShort is returned by Resize when the new queue length is less
+// than the number of functions in the queue.
+//
+// ErrDuplicate is returned by CallKeyed when a function with the same key is
+// already waiting in the queue.
+//
+// ErrWaiterOpen is returned by Reopen when the Waiter is not closed.
+//
+// ErrNegativeCost is returned by CallCost when the cost is negative.
+//
+// ErrInvalidBounds is returned by SetDelayBounds when the minimum delay is
+// greater than the maximum delay.
+//
+// ErrInvalidConfig is wrapped by the errors of NewFromConfig and
+// Config.UnmarshalJSON when the configuration is invalid.
+//
+// ErrDrainTimeout is wrapped by the error of CloseAndWaitTimeout when the
+// queued functions were not called within the timeout.
+//
+// ErrPanic is wrapped by the error of Wait and the other functions waiting
+// for the call when the function panics. The panic is still passed to the
+// panic handler, see SetPanicHandler.
+//
+// ErrDropped is returned by Wait and the other functions waiting for the call
+// when the function is dropped by the DropOldest policy of NewWithPolicy or
+// the LagDrop policy of NewLeaky.
+var (
+	ErrWaiterClosed  = fmt.Errorf("waiter is closed")
+	ErrQueueFull     = fmt.Errorf("waiter queue is full")
+	ErrTimeout       = fmt.Errorf("waiter timeout")
+	ErrQueueTooShort = fmt.Errorf("waiter queue is shorter than number of queued functions")
+	ErrDuplicate     = fmt.Errorf("waiter already has function with this key")
+	ErrWaiterOpen    = fmt.Errorf("waiter is not closed")
+	ErrNegativeCost  = fmt.Errorf("waiter call cost is negative")
+	ErrInvalidBounds = fmt.Errorf("waiter minimum delay is greater than maximum delay")
+	ErrInvalidConfig = fmt.Errorf("waiter config is invalid")
+	ErrDrainTimeout  = fmt.Errorf("waiter drain timeout")
+	ErrPanic         = fmt.Errorf("waiter function panicked")
+	ErrDropped       = fmt.Errorf("waiter function dropped")
+)
+
+// CloseError is returned by Close when the Waiter is already closed. It wraps
+// ErrWaiterClosed, so errors.Is(err, ErrWaiterClosed) is true, and reports
+// the data loss of the first Close.
+type CloseError struct {
+	// Queued is the number of queued functions discarded when the Waiter was
+	// closed.
+	Queued int
+}
+
+// Error returns the error message.
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("%v: %d queued functions discarded", ErrWaiterClosed, e.Queued)
+}
+
+// Unwrap returns ErrWaiterClosed.
+func (e *CloseError) Unwrap() error {
+	return ErrWaiterClosed
+}
+
+// task is a function queued in the Waiter.
+type task struct {
+	// fn is the function to call.
+	fn func()
+
+	// delay is the time to wait since the last call before calling fn. If it
+	// is zero, the Waiter delay is used.
+	delay time.Duration
+
+	// maxExtra is the maximum random extra delay added to the delay before
+	// calling fn, see CallJittered.
+	maxExtra time.Duration
+
+	// cost is the number of the Waiter delays, or tokens in token bucket
+	// mode, the task consumes. The zero cost means one delay, and the negative
+	// cost means the task is called without delay.
+	cost int
+
+	// priority is the task priority. The tasks with higher priority are
+	// called first.
+	priority int
+
+	// seq is the sequence number of the task in the queue.
+	seq uint64
+
+	// deadline is the time the task must be called by, see CallBy. It is
+	// zero if the task has no deadline.
+	deadline time.Time
+
+	// group is the task group, see CallFair. The tasks added without group
+	// belong to the empty group.
+	group string
+
+	// weight is the share of the calls of the task group, see CallWeighted.
+	// The zero weight means 1.
+	weight int
+
+	// round is the round robin round of the task in its group, measured in
+	// roundLen units. The tasks of different groups with the same priority
+	// are interleaved by rounds.
+	round uint64
+
+	// key is the task key, see CallKeyed.
+	key string
+
+	// label is the task label, see CallLabeled.
+	label string
+
+	// added is the time the task was added to the queue.
+	added time.Time
+
+	// position receives the number of the queued tasks ahead of the task when
+	// it is added to the queue, see CallTracked. It is nil if the position is
+	// not required.
+	position *int
+
+	// result receives the error for the caller waiting for the task, see
+	// callAndWait, when the task is dropped without calling fn. It is nil if
+	// no caller waits for the task.
+	result chan<- error
+
+	// claimed is set by the worker before calling fn, or by the caller when
+	// it cancels the task, whichever is first. It is nil if the task can't be
+	// cancelled.
+	claimed *atomic.Bool
+}
+
+// roundLen is the length of the round robin round of the task group with
+// weight 1. The task of the group with weight n takes roundLen/n of the round.
+const roundLen = 1 << 16
+
+// step returns the part of the round robin round the task takes, depending on
+// its weight.
+func (t task) step() uint64 {
+	return roundLen / uint64(min(max(t.weight, 1), roundLen))
+}
+
+// expired returns true if the task deadline is before now.
+func (t task) expired(now time.Time) bool {
+	return !t.deadline.IsZero() && t.deadline.Before(now)
+}
+
+// extra returns the random extra delay of the task in the range
+// [0, maxExtra].
+func (t task) extra() time.Duration {
+	if t.maxExtra <= 0 {
+		return 0
+	}
+	return rand.N(t.maxExtra + 1)
+}
+
+// units returns the number of the Waiter delays the task consumes.
+func (t task) units() int {
+	switch {
+	case t.cost < 0:
+		return 0
+	case t.cost == 0:
+		return 1
+	}
+	return t.cost
+}
+
+// before returns true if the task must be called before the u task: it has
+// higher priority, or earlier deadline with the same priority, or earlier
+// round robin round, or it was added earlier in the same round. The tasks with
+// deadline are called before the tasks without deadline.
+func (t task) before(u task) bool {
+	switch {
+	case t.priority != u.priority:
+		return t.priority > u.priority
+	case !t.deadline.Equal(u.deadline):
+		return !t.deadline.IsZero() &&
+			(u.deadline.IsZero() || t.deadline.Before(u.deadline))
+	case t.round != u.round:
+		return t.round < u.round
+	}
+	return t.seq < u.seq
+}
+
+// cancelled returns true if the task was cancelled by the caller.
+func (t task) cancelled() bool {
+	return t.claimed != nil && t.claimed.Load()
+}
+
+// claim marks the task as started by the worker. It returns false if the task
+// was cancelled by the caller and must not be called.
+func (t task) claim() bool {
+	return t.claimed == nil || t.claimed.CompareAndSwap(false, true)
+}
 
 // Waiter represents an object for waiting a specified delay time since the
 // last call before calling the next function. This is useful when needing to
 // call some code with a rate limit.
 type Waiter struct {
-	// delay is the time to wait between calls.
+	// ctx is the context which closes the Waiter when done.
+	ctx context.Context
+
+	// clock is the source of time.
+	clock Clock
+
+	// mu protects the fields which may be changed while the Waiter is running.
+	mu sync.Mutex
+
+	// delay is the time to wait between calls. Protected by mu.
 	delay time.Duration
 
-	// last is the time of the last call.
+	// delayChanged is closed and replaced when the delay changes, to wake up
+	// the worker waiting the previous delay. Protected by mu.
+	delayChanged chan struct{}
+
+	// minDelay and maxDelay are the bounds of the delay set with SetDelay.
+	// The zero maxDelay means no upper bound. Protected by mu.
+	minDelay, maxDelay time.Duration
+
+	// backoff is the factor to change the delay by SignalThrottled and
+	// SignalOK. It is zero if the backoff is not configured, see Backoff.
+	// Protected by mu.
+	backoff float64
+
+	// disabled is a flag to call functions without delay, see SetEnabled.
+	// Protected by mu.
+	disabled bool
+
+	// last is the time of the last call. Protected by mu.
 	last time.Time
 
-	// fnCh is a channel of functions to call.
-	fnCh chan func()
+	// waitMu serializes the waits of the worker and CallNow, so they share
+	// the rate limit.
+	waitMu sync.Mutex
+
+	// pauseUntil is the time before which no function is called. Protected
+	// by mu.
+	pauseUntil time.Time
+
+	// resumed is closed by Resume to wake up the worker waiting while the
+	// Waiter is paused. It is nil if the Waiter is not paused, see Pause.
+	// Protected by mu.
+	resumed chan struct{}
+
+	// burst is the number of calls which may be executed without delay. It is
+	// used in token bucket mode only, see NewBurst.
+	burst int
+
+	// tokens is the number of calls available in token bucket mode. Protected
+	// by mu.
+	tokens float64
+
+	// maxLag is the maximum time the calls may be late for the ideal
+	// schedule. It is used in leaky bucket mode only, see NewLeaky.
+	maxLag time.Duration
+
+	// lagPolicy defines what to do with the calls late for more than maxLag.
+	lagPolicy LagPolicy
+
+	// schedule is the ideal time of the next call in leaky bucket mode.
+	// Protected by mu.
+	schedule time.Time
+
+	// chain is the list of the Waiters each call passes through, see Chain.
+	chain []*Waiter
+
+	// windowMax is the maximum number of calls in the window of the delay
+	// time. It is used in fixed window mode only, see NewWindow.
+	windowMax int
+
+	// windowStart is the start time of the current window in fixed window
+	// mode. Protected by mu.
+	windowStart time.Time
+
+	// windowCalls is the number of calls in the current window in fixed
+	// window mode. Protected by mu.
+	windowCalls int
+
+	// delaySchedule returns the delay for the current time, see SetSchedule.
+	// Protected by mu.
+	delaySchedule func(now time.Time) time.Duration
+
+	// jitter is the fraction of the delay used to randomize the time to wait
+	// between calls. Protected by mu.
+	jitter float64
+
+	// panicHandler is called when a function panics. Protected by mu.
+	panicHandler func(any)
+
+	// rejectHandler is called with the functions rejected or discarded
+	// because the Waiter is closed. Protected by mu.
+	rejectHandler func(fn func())
+
+	// latency is the maximum time a function may wait in the queue before
+	// latencyHandler is called. Protected by mu.
+	latency time.Duration
+
+	// latencyHandler is called with the time in queue of the functions which
+	// waited longer than latency. Protected by mu.
+	latencyHandler func(latency time.Duration)
+
+	// logger is used to log the Waiter state changes. Protected by mu.
+	logger Logger
+
+	// stopCancel is closed to cancel the deadline set with StopAt. It is nil
+	// if there is no deadline. Protected by mu.
+	stopCancel chan struct{}
+
+	// slow is the maximum time a function may run before slowHandler is
+	// called. Protected by mu.
+	slow time.Duration
+
+	// slowHandler is called with the run time of the functions which ran
+	// longer than slow. Protected by mu.
+	slowHandler func(duration time.Duration)
+
+	// emptyHandler is called when the last pending function is called, see
+	// OnEmpty. Protected by mu.
+	emptyHandler func()
+
+	// highWaterHandler is called when the queue reaches a new maximum
+	// length, see SetOnHighWater. Protected by mu.
+	highWaterHandler func(depth int)
+
+	// gate is the condition to call functions, see SetGate. Protected by mu.
+	gate func() bool
+
+	// beforeWait is called with the time the worker sleeps before each call.
+	// Protected by mu.
+	beforeWait func(sleep time.Duration)
+
+	// stats contains the Waiter counters.
+	stats stats
+
+	// pending is the number of queued and executing functions. Protected by
+	// mu.
+	pending int
+
+	// flushed is signaled when pending becomes zero or the worker exits.
+	flushed *sync.Cond
+
+	// exited is a flag to indicate the worker has exited, so Flush does not
+	// wait for the functions left in the queue. Protected by mu.
+	exited bool
+
+	// keys is the set of keys of pending tasks added with CallKeyed.
+	// Protected by mu.
+	keys map[string]struct{}
+
+	// shared is the map of in-flight calls added with CallShared by key.
+	// Protected by mu.
+	shared map[string]*sharedCall
+
+	// discarded is the number of queued functions discarded by Close.
+	// Protected by mu.
+	discarded int
+
+	// coalesce is a flag to skip the duplicate keyed tasks in the worker, see
+	// SetCoalesce. Protected by mu.
+	coalesce bool
+
+	// lastKey is the key of the last called task, and lastKeyAt is the time
+	// it was called. Protected by mu.
+	lastKey   string
+	lastKeyAt time.Time
+
+	// q is a queue of functions to call.
+	q *queue
 
 	// closed is a flag to indicate if the waiter is closed.
 	closed atomic.Bool
+
+	// stop is a flag to stop the worker without calling queued functions.
+	stop atomic.Bool
+
+	// halt is closed when the worker is stopped, to interrupt its sleep.
+	// Protected by mu.
+	halt chan struct{}
+
+	// stopped is closed when the worker goroutine exits. Protected by mu.
+	stopped chan struct{}
+
+	// done is closed when the Waiter is closed, see Done. Protected by mu.
+	done chan struct{}
+
+	// events is a channel of the function call times, see Events. Protected
+	// by mu.
+	events chan time.Time
+
+	// inline is a flag to call functions on the calling goroutine without
+	// the worker, see NewSync.
+	inline bool
+
+	// poolSize is the number of pool workers. It is zero if the Waiter has no
+	// pool, see NewPool.
+	poolSize int
+
+	// workCh is a channel to pass functions to the pool workers. It is nil if
+	// the Waiter has no pool.
+	workCh chan task
+
+	// workers waits for the pool workers to exit.
+	workers sync.WaitGroup
+
+	// sem limits the number of functions executing at the same time, see
+	// NewLimited. It is nil if the number is not limited.
+	sem chan struct{}
 }
 
 // New creates a new Waiter object.
@@ -42,13 +446,281 @@ type Waiter struct {
 // The Waiter object is used to wait a specified delay time since the last call
 // before calling the next function. This is useful when needing to call some code
 // with a rate limit.
+//
+// The zero delay means no rate limiting, the functions are called one after
+// another without waiting. The negative delay is treated as zero, and so is
+// the negative queueLen.
+//
+// The Waiter must be closed with Close or CloseAndWait when it is not needed
+// any more, otherwise its worker goroutine runs for the process lifetime.
 func New(delay time.Duration, queueLen int) *Waiter {
-	w := &Waiter{
-		delay: delay,
-		last:  time.Now(),
-		fnCh:  make(chan func(), queueLen),
+	return NewWithOptions(delay, WithQueueLen(queueLen))
+}
+
+// NewValidated creates a new Waiter object the same as New, but validates the
+// arguments first. It returns the error wrapping ErrInvalidConfig if delay or
+// queueLen is negative.
+func NewValidated(delay time.Duration, queueLen int) (*Waiter, error) {
+	switch {
+	case delay < 0:
+		return nil, fmt.Errorf("%w: negative delay", ErrInvalidConfig)
+	case queueLen < 0:
+		return nil, fmt.Errorf("%w: negative queue length", ErrInvalidConfig)
+	}
+	return New(delay, queueLen), nil
+}
+
+// NewWithContext creates a new Waiter object which is closed when the
+// specified context is done.
+//
+// The function is similar to New, but the Waiter lifecycle is bound to the
+// ctx context. When ctx is cancelled, the Waiter behaves as if Close was
+// called: queued functions are not called and new calls return
+// ErrWaiterClosed.
+func NewWithContext(ctx context.Context, delay time.Duration, queueLen int) *Waiter {
+	w := newWaiter(ctx, delay, queueLen)
+	w.start()
+	return w
+}
+
+// NewBurst creates a new Waiter object which allows bursts of calls.
+//
+// The Waiter works as a token bucket: up to burst calls are executed
+// immediately, then the calls are executed with the specified delay. One
+// token is added to the bucket every delay time, so after a pause the Waiter
+// allows a new burst. If burst is less than 2 the Waiter works as a Waiter
+// created with New.
+func NewBurst(delay time.Duration, queueLen, burst int) *Waiter {
+	w := newWaiter(context.Background(), delay, queueLen)
+	w.burst = burst
+	w.tokens = float64(burst)
+	w.start()
+	return w
+}
+
+// NewPool creates a new Waiter object which calls functions in a pool of
+// workers goroutines.
+//
+// The Waiter waits the specified delay time between passing functions to the
+// workers, but the functions may execute concurrently. This is useful when the
+// functions do slow I/O and the rate limit only concerns the time between
+// calls. If workers is less than 1, one worker is started.
+func NewPool(delay time.Duration, queueLen, workers int) *Waiter {
+	w := newWaiter(context.Background(), delay, queueLen)
+	w.poolSize = max(workers, 1)
+	w.start()
+	return w
+}
+
+// NewLimited creates a new Waiter object which limits both the rate and the
+// number of functions executing at the same time.
+//
+// The Waiter waits the specified delay time between calls the same as
+// NewPool, but no more than maxConcurrent functions execute concurrently. If
+// maxConcurrent functions are executing, the function is not called until one
+// of them returns, even if the delay has elapsed, and the delay is waited
+// after that. This models the APIs which limit both the request rate and the
+// simultaneous connections. If maxConcurrent is less than 1, one function
+// executes at a time.
+func NewLimited(delay time.Duration, queueLen, maxConcurrent int) *Waiter {
+	w := newWaiter(context.Background(), delay, queueLen)
+	w.poolSize = max(maxConcurrent, 1)
+	w.sem = make(chan struct{}, w.poolSize)
+	w.start()
+	return w
+}
+
+// start starts the worker goroutine and the pool workers. The Waiter created
+// with NewSync has no worker, so it is marked as stopped.
+func (w *Waiter) start() {
+	if w.inline {
+		close(w.stopped)
+		return
+	}
+	if w.poolSize > 0 {
+		w.workCh = make(chan task)
+		for range w.poolSize {
+			w.workers.Add(1)
+			go func() {
+				defer w.workers.Done()
+				for t := range w.workCh {
+					w.execute(t)
+					w.release()
+				}
+			}()
+		}
 	}
 	go w.run()
+}
+
+// LagPolicy defines what a Waiter created with NewLeaky does when its calls
+// are late for more than the maximum lag.
+type LagPolicy int
+
+// Lag policies.
+//
+// LagFastForward moves the schedule to the current time, so the late call is
+// executed and the next calls are spaced from it. The missed schedule slots
+// are lost.
+//
+// LagDrop skips the late calls until the lag is less than the maximum lag.
+// The skipped functions are never called, and the callers waiting for them,
+// like Wait, get ErrDropped.
+const (
+	LagFastForward LagPolicy = iota
+	LagDrop
+)
+
+// OverflowPolicy defines what the Waiter does when a function is added to its
+// full queue, see NewWithPolicy.
+type OverflowPolicy int
+
+// Overflow policies.
+//
+// Block waits until there is room in the queue. The producers are slowed down
+// to the Waiter rate, and no function is lost. This is the default policy.
+//
+// DropNewest rejects the new function: Call returns ErrQueueFull without
+// waiting. The producers are never blocked, and the queued functions are kept.
+//
+// DropOldest removes the first function from the queue to make room for the
+// new one, so the queue keeps the freshest functions. The producers are never
+// blocked, and the removed functions are never called: they are passed to the
+// reject handler and counted in Stats.Rejected, and the callers waiting for
+// them, like Wait, get ErrDropped. This is useful for real-time data where the
+// old work is stale.
+const (
+	Block OverflowPolicy = iota
+	DropNewest
+	DropOldest
+)
+
+// String returns the name of the overflow policy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "Block"
+	case DropNewest:
+		return "DropNewest"
+	case DropOldest:
+		return "DropOldest"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// NewWithPolicy creates a new Waiter object with the specified queue overflow
+// policy.
+//
+// The function is similar to New, but the policy defines what the functions
+// adding to the queue, like Call, do when the queue is full.
+func NewWithPolicy(delay time.Duration, queueLen int, policy OverflowPolicy) *Waiter {
+	w := newWaiter(context.Background(), delay, queueLen)
+	w.q.policy = policy
+	w.start()
+	return w
+}
+
+// NewLeaky creates a new Waiter object which calls functions by the ideal
+// schedule with the rate interval between calls.
+//
+// The Waiter works as a leaky bucket: each call is scheduled rate time after
+// the previous scheduled call, or at the time it was added to an empty queue.
+// If the functions are slow, the calls become late for the schedule and the
+// Waiter calls the next functions without delay to catch up. If the calls are
+// late for more than maxLag, the policy defines whether the schedule is fast
+// forwarded or the late calls are dropped. This bounds the catch-up bursts
+// which may exceed the limit of the API provider.
+func NewLeaky(rate time.Duration, queueLen int, maxLag time.Duration, policy LagPolicy) *Waiter {
+	w := newWaiter(context.Background(), rate, queueLen)
+	w.maxLag = maxLag
+	w.lagPolicy = policy
+	w.start()
+	return w
+}
+
+// Chain creates a new Waiter object which calls each function only after it
+// passed through the rate limits of all the specified Waiters.
+//
+// This models the compound limits of the API providers, like 10 calls per
+// second and 100 calls per minute: the functions added to the chain are
+// called in order, each one after it waited its turn in every Waiter of the
+// chain, so all the limits are satisfied. The chain Waiters may be used
+// directly too, and the chain calls share their limits. The chain queue
+// length is the longest queue length of the chain Waiters. If a chain Waiter
+// is closed, the functions of the chain are skipped.
+func Chain(waiters ...*Waiter) *Waiter {
+	var queueLen int
+	for _, s := range waiters {
+		queueLen = max(queueLen, s.Cap())
+	}
+	w := newWaiter(context.Background(), 0, queueLen)
+	w.chain = waiters
+	w.start()
+	return w
+}
+
+// NewSync creates a new Waiter object which calls functions synchronously on
+// the calling goroutine, without the queue and the worker goroutine.
+//
+// Call and the other functions adding to the Waiter wait the delay since the
+// last call under a mutex and call the function before they return. This
+// removes the goroutine hop for the callers which call the Waiter from one
+// goroutine, like tight loops and benchmarks. The rate limit is the same as
+// for the Waiter created with New. The queue of the Waiter is always empty,
+// and the Events channel is never closed.
+func NewSync(delay time.Duration) *Waiter {
+	w := newWaiter(context.Background(), delay, 0)
+	w.inline = true
+	w.start()
+	return w
+}
+
+// NewUnbounded creates a new Waiter object with the unbounded queue of
+// functions to call.
+//
+// The functions adding to the queue, like Call, never block or return
+// ErrQueueFull, so the producers are never slowed down, and Len reports the
+// backlog size. Cap returns math.MaxInt. The queue grows while the functions
+// are added faster than the delay allows, so the process may run out of
+// memory if the producers never stop.
+func NewUnbounded(delay time.Duration) *Waiter {
+	return New(delay, math.MaxInt)
+}
+
+// NewWindow creates a new Waiter object which calls up to maxPerWindow
+// functions in each window of time.
+//
+// The Waiter works as a fixed window counter: the first maxPerWindow functions
+// of the window are called without delay, then the worker waits until the
+// window rolls over. This matches the API providers which limit the number of
+// calls per minute or hour but do not care about the spacing. The window is
+// used as the Waiter delay, so SetDelay changes the window length. If
+// maxPerWindow is less than 1, one call per window is allowed.
+func NewWindow(window time.Duration, maxPerWindow, queueLen int) *Waiter {
+	w := newWaiter(context.Background(), window, queueLen)
+	w.windowMax = max(maxPerWindow, 1)
+	w.start()
+	return w
+}
+
+// newWaiter creates a new Waiter object without starting its worker.
+func newWaiter(ctx context.Context, delay time.Duration, queueLen int) *Waiter {
+	w := &Waiter{
+		ctx:          ctx,
+		delay:        max(delay, 0),
+		delayChanged: make(chan struct{}),
+		clock:        realClock{},
+		logger:       nopLogger{},
+		last:         time.Now(),
+		q:            newQueue(max(queueLen, 0)),
+		stopped:      make(chan struct{}),
+		halt:         make(chan struct{}),
+		done:         make(chan struct{}),
+		events:       make(chan time.Time, eventsLen),
+		keys:         make(map[string]struct{}),
+		shared:       make(map[string]*sharedCall),
+	}
+	w.flushed = sync.NewCond(&w.mu)
 	return w
 }
 
@@ -62,116 +734,2218 @@ func New(delay time.Duration, queueLen int) *Waiter {
 //
 // For example, if you need to call a function at a rate of 100 per second, you
 // can use RateLimit(100, 1*time.Second) in the New function call.
+//
+// If quantity is zero or negative, RateLimit returns delay unchanged, which
+// means one call per delay.
 func RateLimit(quantity int, delay time.Duration) time.Duration {
+	if quantity <= 0 {
+		return delay
+	}
 	return delay / time.Duration(quantity)
 }
 
-// Call calls the specified function after waiting the specified delay time
-// since the last call.
+// SetDelay sets the time to wait between calls.
 //
-// If the Waiter is closed, the function will return ErrWaiterClosed.
-func (w *Waiter) Call(fn func()) (err error) {
-	if w.closed.Load() {
-		// If the Waiter is closed, return ErrWaiterClosed
-		err = ErrWaiterClosed
-		return
-	}
-
-	// Add the function to the channel of functions to call
-	w.fnCh <- fn
-	return
+// The new delay is used right away: a function which is already waiting is
+// called when the new delay since the last call elapses, so shortening a long
+// delay takes effect without waiting for the previous one. The delay is
+// clamped into the bounds set with SetDelayBounds.
+func (w *Waiter) SetDelay(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.setDelayLocked(d)
 }
 
-// Wait calls the specified function after waiting the specified delay time
-// since the last call.
-//
-// This function is similar to Call but it waits until the specified function
-// is called and returns any error that occurred.
-func (w *Waiter) Wait(fn func()) error {
-	// Create a channel to receive the error
-	done := make(chan error)
+// setDelayLocked sets the delay clamped into the delay bounds and wakes up
+// the worker waiting the previous delay. It must be called with mu locked.
+func (w *Waiter) setDelayLocked(d time.Duration) {
+	w.delay = w.clampDelay(d)
+	w.notifyDelay()
+}
 
-	// Start a new goroutine to call the function
-	go func() {
-		// Call the function with the specified delay
-		if err := w.Call(func() {
-			// Call the function
-			if fn != nil {
-				fn()
-			}
+// notifyDelay wakes up the worker waiting the delay since the last call, so
+// it recalculates the time to wait. It must be called with mu locked.
+func (w *Waiter) notifyDelay() {
+	close(w.delayChanged)
+	w.delayChanged = make(chan struct{})
+}
 
-			// Send nil error to the channel
-			done <- nil
-		}); err != nil {
-			// If there is an error, send it to the channel
-			done <- err
-		}
-	}()
+// SetCoalesce enables or disables coalescing of the duplicate functions added
+// with CallKeyed.
+//
+// In coalesce mode CallKeyed does not return ErrDuplicate, it adds the
+// function with the same key to the queue. The worker skips the function if
+// the previous called function had the same key and was called after the
+// function was added: the previous call has already done the work, which
+// saves the rate budget for idempotent refreshes. The functions added after
+// the previous call started are called.
+func (w *Waiter) SetCoalesce(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.coalesce = enabled
+}
 
-	// Wait until the f function is called and error is received
-	// from the done channel
-	return <-done
+// SetSchedule sets the function which returns the delay for the current time.
+//
+// The worker calls fn before each wait to get the delay instead of the delay
+// set with New or SetDelay, so different delays may be used at different
+// times of the day, like a tighter quota during business hours. The function
+// is called for each call, so it must be fast. If fn is nil, the delay set
+// with SetDelay is used again.
+func (w *Waiter) SetSchedule(fn func(now time.Time) time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.delaySchedule = fn
+	w.notifyDelay()
 }
 
-// Len returns the number of functions currently waiting in the channel.
-func (w *Waiter) Len() int {
-	return len(w.fnCh)
+// SetEnabled enables or disables the rate limit.
+//
+// When the rate limit is disabled, the queued functions are called one by one
+// without any delay between them. Unlike SetDelay(0) the configured delay is
+// kept, and it is used again after the rate limit is enabled. The next call
+// after enabling is spaced from the last call made while disabled. Disabling
+// does not cancel a pause: the Waiter paused with Pause until Resume, or until
+// the quota reset set with AdjustFromHeaders, calls nothing even when the rate
+// limit is disabled.
+func (w *Waiter) SetEnabled(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.disabled = !enabled
 }
 
-// Close closes the Waiter and stops it from calling any more functions.
+// SetDelayBounds sets the minimum and maximum delay, so any delay set with
+// SetDelay or AdjustFromHeaders is clamped into [minDelay, maxDelay].
 //
-// If the Waiter is already closed, the function will return ErrWaiterClosed
-// error.
-func (w *Waiter) Close() (err error) {
-	// Set the closed flag to true
-	if !w.closed.CompareAndSwap(false, true) {
-		// If the flag is already true, return ErrWaiterClosed
-		err = ErrWaiterClosed
+// This protects from the bad delays computed from the upstream data, which
+// could stall the Waiter or hammer the API. The current delay is clamped
+// too. The zero maxDelay means no upper bound. If minDelay is greater than
+// maxDelay, SetDelayBounds returns ErrInvalidBounds and the bounds are not
+// changed.
+func (w *Waiter) SetDelayBounds(minDelay, maxDelay time.Duration) error {
+	if maxDelay > 0 && minDelay > maxDelay {
+		return ErrInvalidBounds
 	}
-	return
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.minDelay, w.maxDelay = minDelay, maxDelay
+	w.setDelayLocked(w.delay)
+	return nil
 }
 
-// run starts a new goroutine to run the Waiter object.
-// It loops through the channel of functions to call and calls them with the
-// specified delay.
-func (w *Waiter) run() {
-	// Loop through the channel of functions to call
-	for fn := range w.fnCh {
-		// If the Waiter is closed, exit the loop
-		if w.closed.Load() {
-			break
-		}
+// Backoff configures the exponential backoff of the delay driven by
+// SignalThrottled and SignalOK.
+//
+// The delay is multiplied by factor on each SignalThrottled, up to maxDelay,
+// and divided by factor on each SignalOK, down to minDelay. This makes the
+// Waiter a self tuning limiter for the APIs which report throttling, for
+// example with HTTP 429 responses. The bounds are set as with SetDelayBounds,
+// and swapped if minDelay is greater than maxDelay. If factor is not greater
+// than 1, the factor 2 is used.
+func (w *Waiter) Backoff(minDelay, maxDelay time.Duration, factor float64) {
+	if maxDelay > 0 && minDelay > maxDelay {
+		minDelay, maxDelay = maxDelay, minDelay
+	}
+	if factor <= 1 {
+		factor = 2
+	}
 
-		// Wait the specified delay before calling the function
-		w.wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.minDelay, w.maxDelay = minDelay, maxDelay
+	w.backoff = factor
+	w.setDelayLocked(w.delay)
+}
 
-		// Call the function
-		if fn != nil {
-			fn()
-		}
+// SignalThrottled increases the delay by the backoff factor after the API
+// provider throttled a call. It does nothing if the backoff is not configured
+// with Backoff.
+func (w *Waiter) SignalThrottled() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.backoff == 0 {
+		return
 	}
+	w.setDelayLocked(time.Duration(float64(w.delay) * w.backoff))
 }
 
-// wait waits the specified delay time since the last call before calling the
-// next function.
-func (w *Waiter) wait() {
-	// Get the current time
-	now := time.Now()
+// SignalOK decreases the delay by the backoff factor after a successful call.
+// It does nothing if the backoff is not configured with Backoff.
+func (w *Waiter) SignalOK() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	// If the last call time is zero, set it to the current time
-	if w.last.IsZero() {
-		w.last = now
+	if w.backoff == 0 {
 		return
 	}
+	w.setDelayLocked(time.Duration(float64(w.delay) / w.backoff))
+}
+
+// clampDelay returns the delay clamped into the delay bounds. It must be
+// called with mu locked.
+func (w *Waiter) clampDelay(d time.Duration) time.Duration {
+	d = max(d, w.minDelay)
+	if w.maxDelay > 0 {
+		d = min(d, w.maxDelay)
+	}
+	return d
+}
 
-	// Calculate the time elapsed since the last call
-	elapsed := now.Sub(w.last)
+// Delay returns the time to wait between calls.
+func (w *Waiter) Delay() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.delay
+}
 
-	// If the elapsed time is less than the delay, sleep for the difference
-	if elapsed < w.delay {
-		time.Sleep(w.delay - elapsed)
+// RatePerSecond returns the number of calls per second implied by the delay,
+// the inverse of RateLimit. It is useful to log or monitor the configured rate
+// in familiar units. If the delay is zero, the rate is not limited and
+// RatePerSecond returns +Inf.
+func (w *Waiter) RatePerSecond() float64 {
+	d := w.Delay()
+	if d <= 0 {
+		return math.Inf(1)
 	}
+	return float64(time.Second) / float64(d)
+}
+
+// Policy returns the queue overflow policy, see NewWithPolicy.
+func (w *Waiter) Policy() OverflowPolicy {
+	return w.q.policy
+}
+
+// Burst returns the number of calls the Waiter allows without delay, see
+// NewBurst. It returns 1 if the Waiter does not allow bursts.
+func (w *Waiter) Burst() int {
+	return max(w.burst, 1)
+}
+
+// SetJitter sets the fraction of the delay used to randomize the time to wait
+// between calls.
+//
+// With jitter the time to wait between calls is a random value in the range
+// delay ± delay*fraction. This is useful to decorrelate many Waiters with the
+// same delay. The fraction is clamped to the range [0, 1]. The zero fraction,
+// which is the default, disables jitter.
+func (w *Waiter) SetJitter(fraction float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.jitter = min(max(fraction, 0), 1)
+}
+
+// SetPanicHandler sets the function to call when a scheduled function panics.
+//
+// The Waiter recovers from the panics of scheduled functions and continues
+// calling the next functions. The panic value is passed to the handler h. If
+// the handler is not set or h is nil, the panic value is printed to stderr.
+func (w *Waiter) SetPanicHandler(h func(any)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.panicHandler = h
+}
+
+// SetLatencyThreshold sets the function to call when a function waits in the
+// queue longer than the specified threshold d.
+//
+// The time in queue is measured from adding the function to the Waiter until
+// the worker takes it from the queue. The handler h is called with this time
+// in the worker goroutine, before waiting the delay. It is an early warning
+// that the Waiter is saturated. If d is zero or h is nil, the latency is not
+// checked.
+func (w *Waiter) SetLatencyThreshold(d time.Duration, h func(latency time.Duration)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.latency = d
+	w.latencyHandler = h
+}
+
+// SetSlowCallThreshold sets the function to call when a scheduled function
+// runs longer than the specified threshold d.
+//
+// The slow function delays all the functions queued after it, because the
+// functions are called one by one. The handler h is called with the function
+// run time in the worker goroutine right after the function returns. If d is
+// zero or h is nil, the run time is not checked.
+func (w *Waiter) SetSlowCallThreshold(d time.Duration, h func(duration time.Duration)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.slow = d
+	w.slowHandler = h
+}
+
+// OnEmpty sets the function to call when the queue becomes empty.
+//
+// The handler h is called in the worker goroutine when the last pending
+// function is called or skipped, for example cancelled, expired, coalesced or
+// dropped: the queue is empty and no other function is waiting or executing.
+// It is called once per transition from non-empty to empty, so a downstream
+// stage may know a batch is completed without polling.
+// If h is nil, the handler is removed.
+func (w *Waiter) OnEmpty(h func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.emptyHandler = h
+}
+
+// SetOnHighWater sets the function to call when the queue reaches a new
+// maximum length, see MaxLen.
+//
+// The handler h is called with the new maximum in the goroutine which added
+// the function to the queue, after it is added. It is useful to size the
+// queue by the observed load. If h is nil, the handler is removed.
+func (w *Waiter) SetOnHighWater(h func(depth int)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.highWaterHandler = h
+}
+
+// gatePoll is the interval to check the gate set with SetGate.
+const gatePoll = 10 * time.Millisecond
+
+// SetGate sets the condition which must be true to call the next function.
+//
+// Before each function call the worker checks the gate every 10ms until it
+// returns true, then waits the delay and calls the function. While the gate
+// is false, the functions accumulate in the queue. This integrates the Waiter
+// with the external health signals, like an open circuit breaker. If gate is
+// nil, the functions are called without the condition.
+func (w *Waiter) SetGate(gate func() bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.gate = gate
+}
+
+// SetBeforeWait sets the function to call right before the worker sleeps to
+// honor the delay, with the time it will sleep.
+//
+// The handler h is called in the worker goroutine before each function call.
+// The sleep is zero if the function is called without waiting, for example
+// when the time elapsed since the last call is longer than the delay. The
+// handler should be fast, because the next call is delayed while it runs. It
+// is useful to trace how much the Waiter throttles the calls.
+func (w *Waiter) SetBeforeWait(h func(sleep time.Duration)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.beforeWait = h
+}
+
+// AdjustFromHeaders sets the delay from the rate limit quota reported by the
+// API provider, usually in the response headers.
+//
+// The remaining is the number of calls left in the quota until it is renewed
+// at resetAt. The delay is set to the time until resetAt divided by
+// remaining, as with SetDelay. If remaining is zero, the delay is not changed
+// but no function is called until resetAt.
+func (w *Waiter) AdjustFromHeaders(remaining int, resetAt time.Time) {
+	if remaining <= 0 {
+		w.mu.Lock()
+		w.pauseUntil = resetAt
+		w.mu.Unlock()
+		return
+	}
+	w.SetDelay(max(resetAt.Sub(w.clock.Now()), 0) / time.Duration(remaining))
+}
+
+// Reset resets the time of the last call, so the next function is called
+// without delay.
+//
+// This is useful when the quota of the API provider is known to be just
+// renewed. A function which is already waiting finishes its wait.
+func (w *Waiter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = time.Time{}
+}
+
+// Pause pauses the Waiter until Resume or ResumeAfterDelay is called.
+//
+// The functions are still added to the queue while the Waiter is paused, but
+// none of them is called. A function which is already waiting the delay when
+// Pause is called may still be called. Pausing the paused Waiter does nothing.
+func (w *Waiter) Pause() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.resumed == nil {
+		w.resumed = make(chan struct{})
+	}
+}
+
+// Resume resumes the Waiter paused with Pause, so the queued functions are
+// called in the order they were added.
+//
+// The delay is measured since the last call before the pause, so after a long
+// pause the first function is called immediately. Use ResumeAfterDelay to wait
+// the full delay before the first function. Resuming the Waiter which is not
+// paused does nothing.
+func (w *Waiter) Resume() {
+	w.resume(false)
+}
+
+// ResumeAfterDelay resumes the Waiter paused with Pause the same as Resume,
+// but resets the last call time to now, so the first function after the
+// pause waits the full delay and the next ones are spaced from it.
+func (w *Waiter) ResumeAfterDelay() {
+	w.resume(true)
+}
+
+// resume resumes the paused Waiter and resets the last call time to now if
+// reset is true.
+func (w *Waiter) resume(reset bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.resumed == nil {
+		return
+	}
+	if reset {
+		w.last = w.clock.Now()
+	}
+	close(w.resumed)
+	w.resumed = nil
+}
+
+// waitResume waits until the paused Waiter is resumed or the worker is
+// stopped.
+func (w *Waiter) waitResume() {
+	w.mu.Lock()
+	resumed, halt := w.resumed, w.halt
+	w.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-halt:
+	}
+}
+
+// SetOnReject sets the function to call with the functions which are not
+// called because the Waiter is closed, or because they are dropped from the
+// full queue by the DropOldest policy.
+//
+// The handler h is called when Call or other function adding a function to the
+// Waiter returns ErrWaiterClosed, in the goroutine of the caller. It is also
+// called for the functions left in the queue when the Waiter is closed with
+// Close, in the worker goroutine, and for the functions dropped by DropOldest,
+// in the goroutine which added the new function. The handler is never called
+// under the Waiter lock, so it may use the Waiter.
+func (w *Waiter) SetOnReject(h func(fn func())) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rejectHandler = h
+}
+
+// LastCall returns the time of the last call, which is the time the last
+// function finished waiting its turn.
+//
+// If no function has been called yet, LastCall returns the time the Waiter was
+// created, and after Reset it returns the zero time. The time which is long
+// ago while the queue is not empty means the worker is stuck.
+func (w *Waiter) LastCall() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// NextAllowed returns the time from now until the next function may be
+// called, or 0 if it may be called immediately.
+//
+// The value is a snapshot of the Waiter state and may change as the functions
+// are called or the Waiter settings change. The disabled Waiter, see
+// SetEnabled, returns 0 unless it is paused. The Waiter paused with Pause
+// returns the maximum duration, because the next function waits for Resume.
+func (w *Waiter) NextAllowed() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock.Now()
+	var next time.Time
+	switch {
+	case w.resumed != nil:
+		// Wait for Resume
+		return time.Duration(math.MaxInt64)
+	case w.disabled:
+		// The calls are not limited
+	case w.burst > 1:
+		// Wait for the next token in the token bucket
+		if tokens := w.availableTokens(now); tokens < 1 {
+			next = now.Add(time.Duration((1 - tokens) * float64(w.delay)))
+		}
+	case w.maxLag > 0:
+		// Wait for the leaky bucket schedule
+		next = w.schedule
+	case w.windowMax > 0:
+		// Wait for the next window if the current one is full
+		if w.windowCalls >= w.windowMax && now.Sub(w.windowStart) < w.delay {
+			next = w.windowStart.Add(w.delay)
+		}
+	case !w.last.IsZero():
+		// Wait for the delay since the last call
+		next = w.last.Add(w.delay)
+	}
+	if w.pauseUntil.After(next) {
+		next = w.pauseUntil
+	}
+	return max(next.Sub(now), 0)
+}
+
+// Available returns the number of functions which may be called now without
+// delay.
+//
+// For the Waiter created with NewBurst the tokens accrue while the Waiter is
+// idle, one token per delay, so after an idle period a burst runs without
+// delay. The accrual is capped at the burst size, so Available never exceeds
+// it. For the other Waiters Available returns 1 if the next function may be
+// called immediately, or 0 otherwise. The paused Waiter returns 0, and the
+// disabled one returns the burst size.
+func (w *Waiter) Available() int {
+	if w.burst <= 1 {
+		if w.NextAllowed() > 0 {
+			return 0
+		}
+		return 1
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.clock.Now()
+	switch {
+	case w.pauseUntil.After(now) || w.resumed != nil:
+		return 0
+	case w.disabled:
+		return w.burst
+	}
+	return int(w.availableTokens(now))
+}
+
+// availableTokens returns the number of tokens in the token bucket at the
+// time now, capped at the burst size. It must be called with mu locked.
+func (w *Waiter) availableTokens(now time.Time) float64 {
+	tokens := w.tokens
+	if w.delay > 0 {
+		tokens += float64(now.Sub(w.last)) / float64(w.delay)
+	}
+	if w.delay <= 0 || tokens > float64(w.burst) {
+		tokens = float64(w.burst)
+	}
+	return max(tokens, 0)
+}
+
+// Allow reports whether a call may proceed now without waiting, and takes its
+// slot if so. It is the same as AllowN(1).
+func (w *Waiter) Allow() bool {
+	return w.AllowN(1)
+}
+
+// AllowN reports whether n calls may proceed now without waiting, and takes
+// their slots if so, mirroring the Allow method of the rate.Limiter. It never
+// waits and does not use the queue, but shares the rate limit with the queued
+// functions: if AllowN returns true, the next queued function waits the slots
+// taken by AllowN.
+//
+// The n calls take n delays, so the next queued function waits n delays since
+// now, or they take n tokens in token bucket mode. If the worker is already
+// waiting the delay for a queued function, the slot belongs to it and AllowN
+// returns false. If n is not positive, AllowN returns true and takes nothing.
+func (w *Waiter) AllowN(n int) bool {
+	if n <= 0 {
+		return true
+	}
+	if !w.waitMu.TryLock() {
+		return false
+	}
+	defer w.waitMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock.Now()
+	switch {
+	case w.disabled:
+		// The calls are not limited
+	case w.pauseUntil.After(now) || w.resumed != nil:
+		return false
+	case w.burst > 1:
+		// Take the tokens from the token bucket
+		tokens := w.availableTokens(now)
+		if tokens < float64(n) {
+			return false
+		}
+		w.tokens = tokens - float64(n)
+	case w.maxLag > 0:
+		// Take the leaky bucket schedule slots
+		if w.schedule.After(now) {
+			return false
+		}
+		w.schedule = now.Add(w.delay * time.Duration(n))
+	case w.windowMax > 0:
+		// Take the calls of the current window
+		if w.windowStart.IsZero() || now.Sub(w.windowStart) >= w.delay {
+			w.windowStart, w.windowCalls = now, 0
+		}
+		if w.windowCalls+n > w.windowMax {
+			return false
+		}
+		w.windowCalls += n
+	default:
+		// Take the n delays from now, so the next queued function waits them
+		if !w.last.IsZero() && now.Sub(w.last) < w.delay*time.Duration(n) {
+			return false
+		}
+		w.last = now.Add(w.delay * time.Duration(n-1))
+		return true
+	}
+	w.last = now
+	return true
+}
+
+// Call calls the specified function after waiting the specified delay time
+// since the last call.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) Call(fn func()) (err error) {
+	return w.add(task{fn: fn}, nil)
+}
+
+// TryCall calls the specified function after waiting the specified delay time
+// since the last call. Unlike Call it never blocks: if the queue is full the
+// function is not added and TryCall returns ErrQueueFull.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed. The
+// ErrQueueFull error means the Waiter is working but saturated, so the caller
+// may retry later or shed the load. The ErrWaiterClosed error means the Waiter
+// will never accept the function.
+func (w *Waiter) TryCall(fn func()) (err error) {
+	return w.add(task{fn: fn}, nowait)
+}
+
+// CallWithin calls the specified function after waiting the specified delay
+// time since the last call. If the queue is full, CallWithin waits for room in
+// the queue but not longer than wait, and returns ErrQueueFull if the function
+// was not added.
+//
+// This is the middle ground between Call, which waits for room forever, and
+// TryCall, which never waits. If the Waiter is closed before or during the
+// wait, the function will return ErrWaiterClosed.
+func (w *Waiter) CallWithin(fn func(), wait time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	return w.add(task{fn: fn}, ctx.Done())
+}
+
+// CallPriority calls the specified function after waiting the specified delay
+// time since the last call, before the queued functions with lower priority.
+//
+// The functions added with Call have priority 0. The functions with the same
+// priority are called in the order they were added.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallPriority(priority int, fn func()) (err error) {
+	return w.add(task{fn: fn, priority: priority}, nil)
+}
+
+// CallNow waits the specified delay time since the last call and calls the
+// specified function synchronously on the calling goroutine. The function
+// bypasses the queue and the worker goroutine, but shares the rate limit with
+// the queued functions, so CallNow and Call may be used together.
+//
+// CallNow does not recover from panics, a panic in fn is propagated to the
+// caller.
+func (w *Waiter) CallNow(fn func()) {
+	w.waitMu.Lock()
+	w.wait(task{})
+	w.waitMu.Unlock()
+
+	w.stats.scheduled.Add(1)
+	w.stats.addCall(w.clock.Now())
+	if fn != nil {
+		fn()
+	}
+	w.stats.executed.Add(1)
+}
+
+// CallCost calls the specified function after waiting cost times the
+// specified delay time since the last call. In token bucket mode it takes cost
+// tokens from the bucket.
+//
+// This is useful for API providers which assign different costs to different
+// operations. The zero cost function is called without delay. If cost is
+// negative, the function will return ErrNegativeCost.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallCost(cost int, fn func()) (err error) {
+	switch {
+	case cost < 0:
+		return ErrNegativeCost
+	case cost == 0:
+		cost = -1
+	}
+	return w.add(task{fn: fn, cost: cost}, nil)
+}
+
+// CallBy calls the specified function after waiting the specified delay time
+// since the last call, before the functions with later deadlines.
+//
+// The queue is ordered by deadline, earliest deadline first, and the rate
+// limit still applies between the calls. The functions with deadline are
+// called before the functions without deadline of the same priority. If the
+// deadline has passed when the worker takes the function from the queue, the
+// function is skipped. If the Waiter is closed, the function will return
+// ErrWaiterClosed.
+func (w *Waiter) CallBy(deadline time.Time, fn func()) error {
+	return w.add(task{fn: fn, deadline: deadline}, nil)
+}
+
+// CallFair calls the specified function after waiting the specified delay
+// time since the last call, interleaving the functions of different groups.
+//
+// The queue of functions is round robin across the groups, so a group which
+// floods the queue does not starve the other groups: the next function of
+// each group is called before the second functions of the groups. The
+// functions of the same group are called in FIFO order. The functions added
+// with Call belong to the empty group. Priorities set with CallPriority take
+// precedence over the groups.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallFair(group string, fn func()) error {
+	return w.add(task{fn: fn, group: group}, nil)
+}
+
+// CallCancelable calls the specified function after waiting the specified
+// delay time since the last call, and returns the function to cancel it.
+//
+// If cancel is called before the worker takes the function to call, the
+// function is skipped and never called. Calling cancel after the function is
+// called, or many times, does nothing. If the Waiter is closed, the function
+// will return ErrWaiterClosed.
+func (w *Waiter) CallCancelable(fn func()) (cancel func(), err error) {
+	t := task{fn: fn, claimed: new(atomic.Bool)}
+	if err = w.add(t, nil); err != nil {
+		return
+	}
+	cancel = func() { t.claimed.CompareAndSwap(false, true) }
+	return
+}
+
+// CallDone calls the specified function after waiting the specified delay
+// time since the last call, and calls done right after fn returns.
+//
+// Both functions are called in the worker goroutine, so done may be used to
+// chain a continuation without channels or wait groups. If fn panics, done is
+// not called. If the Waiter is closed, the function will return
+// ErrWaiterClosed and done is not called.
+func (w *Waiter) CallDone(fn func(), done func()) error {
+	return w.Call(func() {
+		if fn != nil {
+			fn()
+		}
+		if done != nil {
+			done()
+		}
+	})
+}
+
+// CallLimited calls the specified function after waiting the specified
+// delay time since the last call, and waits at most execTimeout for it to
+// return.
+//
+// The worker runs fn in a separate goroutine. If fn does not return within
+// execTimeout, the worker abandons it and moves on to the next queued
+// function, so one hung function does not block the Waiter forever. The
+// abandoned goroutine may still be running and is not stopped; the leak is
+// logged with the Waiter logger. The panic of fn is recovered the same as in
+// the worker. If the Waiter is closed, the function will return
+// ErrWaiterClosed.
+func (w *Waiter) CallLimited(execTimeout time.Duration, fn func()) error {
+	return w.Call(func() {
+		if fn == nil {
+			return
+		}
+
+		// Call fn in a separate goroutine and wait until it returns or the
+		// timeout expires
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			w.call(fn)
+		}()
+		select {
+		case <-done:
+		case <-w.clock.After(execTimeout):
+			w.logf("waiter: function abandoned after %v", execTimeout)
+		}
+	})
+}
+
+// CallTracked calls the specified function after waiting the specified delay
+// time since the last call, and returns its position in the queue.
+//
+// The position is the number of the queued functions which will be called
+// before fn, captured atomically with adding fn to the queue. The function
+// executing at the moment is not counted. Together with NextAllowed and Delay
+// it may be used to estimate when fn will be called.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallTracked(fn func()) (position int, err error) {
+	err = w.add(task{fn: fn, position: &position}, nil)
+	return
+}
+
+// CallWeighted calls the specified function after waiting the specified
+// delay time since the last call, interleaving the functions of different
+// groups by their weights.
+//
+// It is similar to CallFair, but the group with weight 3 gets three times more
+// calls than the group with weight 1 while both have queued functions. This
+// is useful for a Waiter shared by the tenants which paid for more
+// throughput. The weight is clamped to the range [1, 65536]. The functions
+// added with CallFair and Call have weight 1.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallWeighted(group string, weight int, fn func()) error {
+	return w.add(task{fn: fn, group: group, weight: weight}, nil)
+}
+
+// CallKeyed calls the specified function after waiting the specified delay
+// time since the last call, unless a function with the same key is already
+// waiting to be called.
+//
+// If a function with the same key is pending, the fn function is not added
+// and CallKeyed returns ErrDuplicate. The key is released when the worker
+// starts calling the function, so a function added after that is not a
+// duplicate. This is useful to debounce refreshes of the same resource. In
+// coalesce mode the duplicates are added and skipped by the worker, see
+// SetCoalesce.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallKeyed(key string, fn func()) (err error) {
+	// Reserve the key. The duplicates are added in coalesce mode and skipped
+	// by the worker
+	w.mu.Lock()
+	if _, ok := w.keys[key]; ok && !w.coalesce {
+		w.mu.Unlock()
+		return ErrDuplicate
+	}
+	w.keys[key] = struct{}{}
+	w.mu.Unlock()
+
+	// Add the function and release the key if it was not added
+	t := task{fn: fn, key: key}
+	if err = w.add(t, nil); err != nil {
+		w.releaseKey(t)
+	}
+	return
+}
+
+// sharedCall is the in-flight call of CallShared, which result is shared by
+// the callers with the same key.
+type sharedCall struct {
+	// done is closed when the call is finished and the result is set.
+	done chan struct{}
+
+	// val and err are the result of the call.
+	val any
+	err error
+
+	// dups is the number of callers waiting for the result, except the
+	// first one. Protected by the Waiter mu.
+	dups int
+}
+
+// CallShared calls the specified function after waiting the specified delay
+// time since the last call, and waits until it returns, sharing the call with
+// the concurrent callers with the same key.
+//
+// If a call with the same key is in flight, fn is not added to the queue:
+// CallShared waits until that call returns and gets the same result, so the
+// callers share one execution and one rate limit slot, like singleflight. The
+// shared flag reports whether the result was given to more than one caller.
+// After the call returns, the next call with the same key executes again. If
+// fn panics, the callers get the error wrapping ErrPanic. If the Waiter is
+// closed, the callers get ErrWaiterClosed.
+func (w *Waiter) CallShared(key string, fn func() (any, error)) (val any, err error, shared bool) {
+	// Wait for the in-flight call with the same key
+	w.mu.Lock()
+	if c, ok := w.shared[key]; ok {
+		c.dups++
+		w.mu.Unlock()
+		<-c.done
+		return c.val, c.err, true
+	}
+	c := &sharedCall{done: make(chan struct{})}
+	w.shared[key] = c
+	w.mu.Unlock()
+
+	// Release the callers with the same key whatever happens
+	defer func() {
+		w.mu.Lock()
+		delete(w.shared, key)
+		shared = c.dups > 0
+		w.mu.Unlock()
+		close(c.done)
+	}()
+
+	// Call the function and share its result. The panic of fn is passed to
+	// all the callers as the error wrapping ErrPanic
+	c.err = w.WaitErr(func() (err error) {
+		c.val, err = fn()
+		return
+	})
+	return c.val, c.err, false
+}
+
+// maxLabelLen is the maximum length of the label in bytes, see CallLabeled.
+const maxLabelLen = 256
+
+// CallLabeled calls the specified function after waiting the specified delay
+// time since the last call, and labels it for debugging.
+//
+// The label is not used to call the function, it is only returned by Pending
+// while the function waits in the queue, and is freed when the worker takes
+// the function from the queue. The label longer than 256 bytes is truncated.
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallLabeled(label string, fn func()) error {
+	return w.add(task{fn: fn, label: truncateLabel(label)}, nil)
+}
+
+// truncateLabel truncates the label to maxLabelLen bytes at the rune
+// boundary. The truncated label is copied, so the long label is not retained.
+func truncateLabel(label string) string {
+	if len(label) <= maxLabelLen {
+		return label
+	}
+	n := maxLabelLen
+	for n > 0 && !utf8.RuneStart(label[n]) {
+		n--
+	}
+	return strings.Clone(label[:n])
+}
+
+// CallBatch calls the specified functions after waiting the specified delay
+// time between calls. It returns the number of functions added to the queue.
+//
+// CallBatch adds the functions in order and does not block: it stops at the
+// first function that can't be added and returns the error which stopped it,
+// ErrQueueFull if the queue is full or ErrWaiterClosed if the Waiter is
+// closed. The functions fns[submitted:] are not added.
+func (w *Waiter) CallBatch(fns []func()) (submitted int, err error) {
+	for _, fn := range fns {
+		if err = w.TryCall(fn); err != nil {
+			return
+		}
+		submitted++
+	}
+	return
+}
+
+// CallAfter calls the specified function after waiting the d delay time since
+// the last call instead of the Waiter delay. If d is zero, the Waiter delay is
+// used.
+//
+// This is useful to give more weight to expensive calls in the queue of a
+// single Waiter. In the token bucket mode created with NewBurst the d delay is
+// ignored.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallAfter(d time.Duration, fn func()) (err error) {
+	return w.add(task{fn: fn, delay: d}, nil)
+}
+
+// CallJittered calls the specified function after waiting the Waiter delay
+// plus a random extra delay up to maxExtra since the last call.
+//
+// Only this call is spaced with the extra delay, the other calls keep the
+// exact spacing. This is useful to spread out the retries originating from a
+// single event. In the token bucket mode created with NewBurst and in the
+// window mode created with NewWindow the extra delay is ignored.
+//
+// If the Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) CallJittered(maxExtra time.Duration, fn func()) error {
+	return w.add(task{fn: fn, maxExtra: maxExtra}, nil)
+}
+
+// add adds the task to the queue of functions to call. If the queue is full,
+// add waits until there is room for the task or the done channel is closed,
+// see queue.push. If the Waiter is closed, the task is passed to the reject
+// handler.
+func (w *Waiter) add(t task, done <-chan struct{}) (err error) {
+	if err = w.send(t, done); err == ErrWaiterClosed {
+		w.reject(t, err)
+	}
+	return
+}
+
+// send sends the task to the queue of functions to call.
+func (w *Waiter) send(t task, done <-chan struct{}) (err error) {
+	if w.closed.Load() {
+		// If the Waiter is closed, return ErrWaiterClosed
+		w.stats.rejected.Add(1)
+		err = ErrWaiterClosed
+		return
+	}
+
+	// Call the task on the calling goroutine if the Waiter has no worker
+	if w.inline {
+		err = w.callInline(t)
+		return
+	}
+
+	// Add the task to the queue of functions to call
+	t.added = w.clock.Now()
+	w.addPending(1)
+	dropped, err := w.q.push(t, done)
+	for _, t := range dropped {
+		w.stats.rejected.Add(1)
+		w.reject(t, ErrDropped)
+		w.drop(t, ErrDropped)
+	}
+	if err != nil {
+		w.addPending(-1)
+		if err == ErrWaiterClosed {
+			w.stats.rejected.Add(1)
+		}
+		return
+	}
+	w.stats.scheduled.Add(1)
+	if depth := w.q.len(); w.stats.addLen(depth) {
+		w.notifyHighWater(depth)
+	}
+	return
+}
+
+// callInline waits the delay and calls the task function on the calling
+// goroutine, see NewSync. It returns ErrWaiterClosed without calling the
+// function if the Waiter is closed with Close during the wait.
+func (w *Waiter) callInline(t task) error {
+	w.stats.scheduled.Add(1)
+	w.addPending(1)
+
+	w.waitMu.Lock()
+	err := w.wait(t)
+	w.waitMu.Unlock()
+	switch {
+	case w.stop.Load():
+		t.claim()
+		w.stats.rejected.Add(1)
+		w.skip(t)
+		return ErrWaiterClosed
+	case err != nil:
+		w.drop(t, err)
+	case !t.claim():
+		w.skip(t)
+	default:
+		w.execute(t)
+	}
+	return nil
+}
+
+// addPending adds n to the number of pending functions and signals Flush
+// when there are no pending functions. It returns true if there are no
+// pending functions after the change.
+func (w *Waiter) addPending(n int) (empty bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending += n
+	if w.pending == 0 {
+		w.flushed.Broadcast()
+		return true
+	}
+	return false
+}
+
+// Wait calls the specified function after waiting the specified delay time
+// since the last call.
+//
+// This function is similar to Call but it waits until the specified function
+// is called and returns any error that occurred.
+func (w *Waiter) Wait(fn func()) error {
+	return w.WaitErr(func() error {
+		if fn != nil {
+			fn()
+		}
+		return nil
+	})
+}
+
+// WaitAll calls the specified functions after waiting the specified delay
+// time between calls, and waits until all of them are called.
+//
+// If a function could not be scheduled, the next functions are not scheduled
+// and WaitAll returns the error, for example ErrWaiterClosed, after the
+// already scheduled functions are called. If the Waiter is closed while the
+// functions are queued, the discarded functions are not called and WaitAll
+// returns ErrWaiterClosed. A panic of the function is returned as the error
+// wrapping ErrPanic.
+func (w *Waiter) WaitAll(fns ...func()) (err error) {
+	// Add the functions to the queue
+	type added struct {
+		t    task
+		done chan error
+	}
+	var tasks []added
+	for _, fn := range fns {
+		t, done := newWaitTask(func() error {
+			if fn != nil {
+				fn()
+			}
+			return nil
+		})
+		if err = w.add(t, nil); err != nil {
+			donePool.Put(done)
+			break
+		}
+		tasks = append(tasks, added{t, done})
+	}
+
+	// Wait until all the added functions are called or discarded
+	for _, a := range tasks {
+		if e := w.await(context.Background(), a.t, a.done); err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// WaitErr calls the specified function after waiting the specified delay time
+// since the last call.
+//
+// This function is similar to Wait but the specified function returns an
+// error, and WaitErr returns this error to the caller. If the function could
+// not be scheduled because the Waiter is closed, or it is discarded because
+// the Waiter is closed before the function is called, WaitErr returns
+// ErrWaiterClosed. If the function panics, WaitErr returns the error wrapping
+// ErrPanic.
+func (w *Waiter) WaitErr(fn func() error) error {
+	return w.callAndWait(context.Background(), nil, fn)
+}
+
+// donePool is the pool of channels used by callAndWait to receive the
+// function error.
+var donePool = sync.Pool{New: func() any { return make(chan error, 1) }}
+
+// WaitTimeout calls the specified function after waiting the specified delay
+// time since the last call, and waits until the function is called but not
+// longer than timeout.
+//
+// If the function was not called within the timeout, it is cancelled, so the
+// Waiter skips it instead of calling it late, and WaitTimeout returns
+// ErrTimeout. If the function has already started when the timeout expires,
+// WaitTimeout waits until it finishes.
+func (w *Waiter) WaitTimeout(fn func(), timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := w.WaitContext(ctx, fn)
+	if err == context.DeadlineExceeded {
+		err = ErrTimeout
+	}
+	return err
+}
+
+// WaitContext calls the specified function after waiting the specified delay
+// time since the last call, and waits until the function is called or the
+// context is done.
+//
+// If the context is done before the function is called, the function is
+// cancelled, so the Waiter skips it, and WaitContext returns the context
+// error. If the function has already started when the context is done,
+// WaitContext waits until it finishes. If the Waiter is closed and the
+// function is discarded, WaitContext returns ErrWaiterClosed.
+func (w *Waiter) WaitContext(ctx context.Context, fn func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Add the function to the queue, waiting for room until the context is
+	// done
+	return w.callAndWait(ctx, ctx.Done(), func() error {
+		if fn != nil {
+			fn()
+		}
+		return nil
+	})
+}
+
+// WaitOrFull calls the specified function after waiting the specified delay
+// time since the last call, and waits until the function is called. If the
+// queue is full, WaitOrFull returns ErrQueueFull immediately.
+//
+// Unlike Wait, which waits for room in the full queue with no limit, it gives
+// the synchronous callers a clear signal that the Waiter is saturated. If the
+// Waiter is closed, the function will return ErrWaiterClosed.
+func (w *Waiter) WaitOrFull(fn func()) error {
+	return w.callAndWait(context.Background(), nowait, func() error {
+		if fn != nil {
+			fn()
+		}
+		return nil
+	})
+}
+
+// callAndWait adds the function to the queue, waiting for room until the
+// push channel is closed, and waits until the function is called, the
+// context is done or the worker stops. It returns the function error.
+func (w *Waiter) callAndWait(ctx context.Context, push <-chan struct{}, fn func() error) error {
+	t, done := newWaitTask(fn)
+	if err := w.add(t, push); err != nil {
+		donePool.Put(done)
+		if err == ErrQueueFull && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return err
+	}
+	return w.await(ctx, t, done)
+}
+
+// newWaitTask creates the task which sends the function error to the
+// returned channel, see await.
+func newWaitTask(fn func() error) (task, chan error) {
+	// Get a buffered channel to receive the function error from the pool, so
+	// the worker never blocks when the context is done. The channel is put
+	// back to the pool only when the worker can't send to it any more: the
+	// error is received, or the function is cancelled before it is called
+	done := donePool.Get().(chan error)
+	t := task{claimed: new(atomic.Bool), result: done, fn: func() {
+		// Release the caller if the function panics, and pass the panic on
+		// to the Waiter panic handler
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("%w: %v", ErrPanic, r)
+				panic(r)
+			}
+		}()
+
+		var err error
+		if fn != nil {
+			err = fn()
+		}
+		done <- err
+	}}
+	return t, done
+}
+
+// await waits until the added task created by newWaitTask is called, the
+// context is done or the worker stops, and returns the function error.
+func (w *Waiter) await(ctx context.Context, t task, done chan error) error {
+	w.mu.Lock()
+	stopped := w.stopped
+	w.mu.Unlock()
+
+	// Wait until the function is called, the context is done or the worker
+	// stops
+	select {
+	case err := <-done:
+		donePool.Put(done)
+		return err
+	case <-ctx.Done():
+		// Cancel the function if it has not been started yet
+		if t.claimed.CompareAndSwap(false, true) {
+			donePool.Put(done)
+			return ctx.Err()
+		}
+	case <-stopped:
+		// The function was discarded if it has not been started yet
+		if t.claimed.CompareAndSwap(false, true) {
+			donePool.Put(done)
+			return ErrWaiterClosed
+		}
+	}
+	err := <-done
+	donePool.Put(done)
+	return err
+}
+
+// CallRetry calls the specified function after waiting the specified delay
+// time since the last call, and calls it again while it returns an error, up
+// to attempts times in total. It returns the last error of the function.
+//
+// Each retry is added to the end of the queue again, so the retries respect
+// the rate limit too. If attempts is less than 1, the function is called once.
+// If the Waiter is closed, CallRetry stops retrying and returns
+// ErrWaiterClosed.
+func (w *Waiter) CallRetry(attempts int, fn func() error) (err error) {
+	for range max(attempts, 1) {
+		var fnErr error
+		err = w.WaitContext(context.Background(), func() { fnErr = fn() })
+		if err != nil {
+			return
+		}
+		if err = fnErr; err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Every calls the specified function repeatedly with the Waiter delay between
+// calls, until the returned cancel function is called or the Waiter is
+// closed.
+//
+// The next call of fn is added to the Waiter after the previous call
+// finishes, so the calls never overlap and are spaced by the delay from the
+// previous call finish at least. The cancel function may be called many
+// times and from fn itself. After cancel the queued call of fn is skipped and
+// the goroutine which adds the calls exits.
+func (w *Waiter) Every(fn func()) (cancel func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		for w.WaitContext(ctx, fn) == nil && ctx.Err() == nil {
+		}
+	}()
+	return cancel
+}
+
+// CallLoop calls the specified function repeatedly with the Waiter delay
+// between calls, while it returns true.
+//
+// It is similar to Every, but the loop is stopped by the function itself, for
+// example when there are no more pages to fetch. The loop is also stopped by
+// the returned cancel function, which may be called many times, or when the
+// Waiter is closed.
+func (w *Waiter) CallLoop(fn func() bool) (cancel func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		more := true
+		for more && w.WaitContext(ctx, func() { more = fn() }) == nil &&
+			ctx.Err() == nil {
+		}
+	}()
+	return cancel
+}
+
+// CallResult calls the specified function after waiting the specified delay
+// time since the last call and returns the function result.
+//
+// This function is similar to Waiter.WaitErr but the specified function
+// returns a value of type T together with an error. If the Waiter is closed,
+// CallResult returns the zero value of T and ErrWaiterClosed.
+func CallResult[T any](w *Waiter, fn func() (T, error)) (res T, err error) {
+	err = w.WaitErr(func() (err error) {
+		res, err = fn()
+		return
+	})
+	return
+}
+
+// Submit calls the specified function with the ctx context after waiting the
+// specified delay time since the last call, and returns the function result.
+//
+// Submit waits until the function returns or the context is done, the same
+// as Waiter.WaitContext. If the context is done before the function is
+// called, the function is skipped and Submit returns the zero value of T and
+// the context error. The function gets the same context, so it may stop its
+// work when the context is done. If the Waiter is closed, Submit returns the
+// zero value of T and ErrWaiterClosed.
+func Submit[T any](ctx context.Context, w *Waiter, fn func(context.Context) (T, error)) (res T, err error) {
+	var v T
+	var fnErr error
+	if err = w.WaitContext(ctx, func() { v, fnErr = fn(ctx) }); err != nil {
+		return
+	}
+	return v, fnErr
+}
+
+// CallArg calls the specified function with the arg argument after waiting
+// the specified delay time since the last call.
+//
+// This function is similar to Waiter.Call but the argument is passed
+// explicitly instead of being captured by a closure, so it is bound at the
+// time of the call regardless of the loop variable semantics of the Go
+// version. If the Waiter is closed, CallArg returns ErrWaiterClosed.
+func CallArg[T any](w *Waiter, arg T, fn func(T)) error {
+	return w.Call(func() { fn(arg) })
+}
+
+// Len returns the number of functions currently waiting in the queue.
+func (w *Waiter) Len() int {
+	return w.q.len()
+}
+
+// Pending returns the labels of the functions currently waiting in the queue,
+// in the order they will be called. The functions added without label, see
+// CallLabeled, have the empty label.
+//
+// It is a snapshot for debugging: the function the worker waits the delay for
+// or executes at the moment is not in the queue and is not returned.
+func (w *Waiter) Pending() []string {
+	return w.q.labels()
+}
+
+// WouldBlock returns true if the queue is full, so Call would block until
+// there is room for the function.
+//
+// It is a snapshot, which may change right after WouldBlock returns, but it
+// allows the producers to shed the load before adding to the Waiter. Use
+// TryCall to add the function only if it does not block.
+func (w *Waiter) WouldBlock() bool {
+	return w.q.full()
+}
+
+// Outstanding returns the number of functions which are not finished yet:
+// the functions waiting in the queue, plus the function the worker waits the
+// delay for or executes at the moment.
+//
+// Unlike Len it becomes zero only when all the added functions are finished,
+// or the Waiter is closed and its worker stops.
+func (w *Waiter) Outstanding() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending
+}
+
+// eventsLen is the buffer length of the Events channel.
+const eventsLen = 64
+
+// Events returns a channel which receives the time of each function call.
+//
+// The channel is buffered for 64 events. The Waiter never waits for the
+// channel reader: if the buffer is full, the event is dropped. The channel is
+// closed when the Waiter is closed and its worker stops.
+func (w *Waiter) Events() <-chan time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.events
+}
+
+// Closed returns true if the Waiter is closed.
+func (w *Waiter) Closed() bool {
+	return w.closed.Load()
+}
+
+// Done returns a channel which is closed when the Waiter is closed, similar
+// to context.Context.Done. It allows to react to the Waiter close in select
+// without polling Closed. The new Done channel should be got after Reopen,
+// because the previous one is closed.
+func (w *Waiter) Done() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.done
+}
+
+// stopWorker sets the stop flag and interrupts the worker sleep, so the worker
+// stops without calling the queued functions.
+func (w *Waiter) stopWorker() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.stop.Swap(true) {
+		close(w.halt)
+	}
+}
+
+// markClosed sets the closed flag and closes the done channel. It returns
+// false if the Waiter is already closed.
+func (w *Waiter) markClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed.CompareAndSwap(false, true) {
+		return false
+	}
+	close(w.done)
+	return true
+}
+
+// String returns the description of the Waiter state, for example:
+//
+//	Waiter{delay=100ms, queued=3/10, policy=Block, burst=1, closed=false}
+//
+// It is safe to call String concurrently with the other Waiter functions.
+func (w *Waiter) String() string {
+	return fmt.Sprintf("Waiter{delay=%v, queued=%d/%d, policy=%v, burst=%d, closed=%t}",
+		w.Delay(), w.Len(), w.Cap(), w.Policy(), w.Burst(), w.Closed())
+}
+
+// Flush waits until all the queued functions are called and returns the
+// number of functions it waited for.
+//
+// Unlike CloseAndWait the Waiter is not closed and accepts new functions.
+// Flush returns when the queue is empty and no function is executing, so the
+// functions added during Flush are waited for too. If the Waiter is closed
+// and its queued functions are discarded, Flush returns immediately after the
+// worker stops.
+func (w *Waiter) Flush() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := w.pending
+	for w.pending > 0 && !w.exited {
+		w.flushed.Wait()
+	}
+	return n
+}
+
+// Cap returns the capacity of the queue of functions to call, which is the
+// queueLen argument of the New function or the length set by Resize. For an
+// unbuffered Waiter created with queueLen 0 it returns 0.
+func (w *Waiter) Cap() int {
+	return w.q.cap()
+}
+
+// Resize changes the capacity of the queue of functions to call.
+//
+// The queued functions are kept, and the callers waiting for room in the
+// queue may continue if the queue grows. If newLen is less than the number of
+// queued functions, Resize returns ErrQueueTooShort and the capacity is not
+// changed.
+func (w *Waiter) Resize(newLen int) error {
+	return w.q.resize(newLen)
+}
+
+// Close closes the Waiter and stops it from calling any more functions.
+//
+// The worker waiting the delay is woken up and stops immediately. The callers
+// blocked in Call or other functions waiting for room in the full queue are
+// woken up and return ErrWaiterClosed. If the Waiter is already closed, the
+// function will return the *CloseError wrapping ErrWaiterClosed, with the
+// number of functions discarded by the first Close.
+func (w *Waiter) Close() (err error) {
+	// Set the closed flag to true
+	if !w.markClosed() {
+		// If the flag is already true, return ErrWaiterClosed
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		err = &CloseError{Queued: w.discarded}
+		return
+	}
+
+	// Stop the worker without calling queued functions and wake up the
+	// callers waiting for room in the queue
+	n := w.q.len()
+	w.mu.Lock()
+	w.discarded = n
+	w.mu.Unlock()
+	w.stopWorker()
+	w.q.close()
+	w.cancelStopAt()
+	w.logf("waiter: closed")
+	return
+}
+
+// StopAt closes the Waiter at the specified time, as with Close.
+//
+// This is useful for the time boxed jobs which call as many functions as
+// possible before the deadline. The function executing at the deadline is
+// finished, but the queued functions are not called and the new functions are
+// rejected. The deadline is waited with the Waiter clock, see NewWithClock.
+// Calling StopAt again replaces the previous deadline. If the Waiter is closed
+// earlier, the deadline is cancelled, so it does not close the Waiter
+// reopened with Reopen.
+func (w *Waiter) StopAt(t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Replace the previous deadline
+	if w.stopCancel != nil {
+		close(w.stopCancel)
+	}
+	cancel := make(chan struct{})
+	w.stopCancel = cancel
+
+	// Close the Waiter at the deadline unless it is cancelled or replaced
+	d := t.Sub(w.clock.Now())
+	go func() {
+		select {
+		case <-w.clock.After(d):
+		case <-cancel:
+			return
+		}
+		w.mu.Lock()
+		current := w.stopCancel == cancel
+		w.mu.Unlock()
+		if current {
+			w.Close()
+		}
+	}()
+}
+
+// cancelStopAt cancels the deadline set with StopAt.
+func (w *Waiter) cancelStopAt() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopCancel != nil {
+		close(w.stopCancel)
+		w.stopCancel = nil
+	}
+}
+
+// CloseAndWait closes the Waiter and waits until all the functions already
+// added to the queue are called.
+//
+// After CloseAndWait is called the Waiter does not accept new functions, but
+// the queued functions are still called with the specified delay. If the
+// Waiter is already closed, the function will return ErrWaiterClosed error.
+func (w *Waiter) CloseAndWait() (err error) {
+	return w.closeAndWait(nil)
+}
+
+// CloseAndWaitTimeout closes the Waiter and waits until all the functions
+// already added to the queue are called, but not longer than timeout.
+//
+// It is similar to CloseAndWait, but bounds the shutdown time. If the queued
+// functions are not called within the timeout, the worker is stopped as with
+// Close, the remaining functions are discarded and passed to the reject
+// handler, and CloseAndWaitTimeout returns an error wrapping ErrDrainTimeout
+// with the number of functions which were not finished. If the Waiter is
+// already closed, the function will return ErrWaiterClosed error.
+func (w *Waiter) CloseAndWaitTimeout(timeout time.Duration) (err error) {
+	return w.closeAndWait(w.clock.After(timeout))
+}
+
+// closeAndWait closes the Waiter and waits until all the queued functions are
+// called or the timeout channel receives. Use the nil timeout to wait
+// forever.
+func (w *Waiter) closeAndWait(timeout <-chan time.Time) (err error) {
+	// Set the closed flag to true
+	if !w.markClosed() {
+		// If the flag is already true, return ErrWaiterClosed
+		err = ErrWaiterClosed
+		return
+	}
+
+	// Close the queue, so the worker exits after calling all the queued
+	// functions
+	w.q.close()
+	w.cancelStopAt()
+	w.logf("waiter: closed, calling %d queued functions", w.q.len())
+
+	// Wait until the worker exits or the timeout expires
+	w.mu.Lock()
+	stopped := w.stopped
+	w.mu.Unlock()
+	select {
+	case <-stopped:
+		return
+	case <-timeout:
+	}
+
+	// Stop the worker and discard the remaining functions
+	n := w.Outstanding()
+	w.mu.Lock()
+	w.discarded = n
+	w.mu.Unlock()
+	w.stopWorker()
+	err = fmt.Errorf("%w: %d functions not called", ErrDrainTimeout, n)
+	return
+}
+
+// Drain closes the Waiter and returns the queued functions which were not
+// called, in the order they would be called.
+//
+// After Drain the Waiter is closed and does not accept new functions. The
+// returned functions are not passed to the reject handler, so the caller may
+// persist or reroute them. The function which is already waiting the delay in
+// the worker is not returned, it is rejected. The functions added by Wait,
+// WaitErr and the other waiting calls are not returned either: they are
+// rejected and their callers get ErrWaiterClosed. If the worker is still calling
+// the queued functions after CloseAndWait, Drain stops it and returns the
+// functions left in the queue.
+func (w *Waiter) Drain() (fns []func()) {
+	// Stop the worker and take all the queued functions
+	w.markClosed()
+	w.stopWorker()
+	for _, t := range w.q.closeAndDrain() {
+		// Release the callers waiting for the functions, which are not
+		// returned, and skip the cancelled functions
+		if t.result != nil {
+			w.reject(t, ErrWaiterClosed)
+			w.drop(t, ErrWaiterClosed)
+			continue
+		}
+		w.skip(t)
+		if t.claim() {
+			fns = append(fns, t.fn)
+		}
+	}
+	return
+}
+
+// Reopen reopens the closed Waiter, so it accepts and calls new functions
+// again with the same settings.
+//
+// If the worker of the closed Waiter is still calling the queued functions
+// after CloseAndWait, Reopen waits until it stops. The new Events channel
+// should be got after Reopen, because the previous one is closed. If the
+// Waiter is not closed, Reopen returns ErrWaiterOpen.
+func (w *Waiter) Reopen() error {
+	if !w.closed.Load() {
+		return ErrWaiterOpen
+	}
+
+	// Wait until the previous worker stops
+	w.mu.Lock()
+	stopped := w.stopped
+	w.mu.Unlock()
+	<-stopped
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Check the Waiter was not reopened by other goroutine
+	if !w.closed.Load() || w.stopped != stopped {
+		return ErrWaiterOpen
+	}
+
+	// Reset the worker state and start a new worker
+	w.stopped = make(chan struct{})
+	w.exited = false
+	w.discarded = 0
+	w.halt = make(chan struct{})
+	w.done = make(chan struct{})
+	w.events = make(chan time.Time, eventsLen)
+	w.stop.Store(false)
+	w.q.open()
+	w.closed.Store(false)
+	w.start()
+	return nil
+}
+
+// run starts a new goroutine to run the Waiter object.
+// It loops through the queue of functions to call and calls them with the
+// specified delay.
+func (w *Waiter) run() {
+	defer close(w.stopped)
+	defer close(w.events)
+
+	// Release the Flush callers when the worker stops
+	defer func() {
+		w.mu.Lock()
+		w.exited = true
+		w.flushed.Broadcast()
+		w.mu.Unlock()
+	}()
+
+	// Stop the pool workers and wait until they exit
+	if w.workCh != nil {
+		defer w.workers.Wait()
+		defer close(w.workCh)
+	}
+
+	// Loop through the queue of functions to call
+	for {
+		t, ok := w.q.pop(w.ctx.Done())
+		if !ok {
+			// If the context is done, close the Waiter. Exit the loop when
+			// the queue is closed and drained
+			if w.ctx.Err() != nil {
+				w.Close()
+				w.discard()
+			}
+			return
+		}
+
+		// If the Waiter is stopped, exit the loop
+		if w.stop.Load() {
+			w.discard(t)
+			return
+		}
+
+		// Check the time the function waited in the queue
+		w.checkLatency(t)
+
+		// Skip the cancelled, expired or coalesced function without waiting
+		if t.cancelled() || t.expired(w.clock.Now()) || w.coalesced(t) {
+			w.skip(t)
+			continue
+		}
+
+		// Wait until the function may execute, the gate is open and the
+		// concurrency limit allows it
+		w.waitGate()
+		if !w.acquire() {
+			w.discard(t)
+			return
+		}
+
+		// Wait the specified delay before calling the function. Drop it if
+		// the wait failed, and skip it if the Waiter was stopped or the
+		// function was cancelled during the wait
+		w.waitMu.Lock()
+		err := w.wait(t)
+		w.waitMu.Unlock()
+		if w.stop.Load() {
+			w.release()
+			w.discard(t)
+			return
+		}
+		if err != nil {
+			w.release()
+			w.drop(t, err)
+			continue
+		}
+		if !t.claim() {
+			w.release()
+			w.skip(t)
+			continue
+		}
+
+		// Pass the function to the pool workers or call it
+		if w.workCh != nil {
+			w.workCh <- t
+			continue
+		}
+		w.execute(t)
+	}
+}
+
+// discard removes the queued tasks from the queue of functions to call and
+// passes them to the reject handler, after the tasks taken from the queue by
+// the worker. The discarded tasks are removed from the pending tasks.
+func (w *Waiter) discard(taken ...task) {
+	for _, t := range append(taken, w.q.drain()...) {
+		w.releaseKey(t)
+		w.reject(t, ErrWaiterClosed)
+		w.addPending(-1)
+	}
+}
+
+// checkLatency calls the latency handler if the task waited in the queue
+// longer than the latency threshold.
+func (w *Waiter) checkLatency(t task) {
+	w.mu.Lock()
+	d, h := w.latency, w.latencyHandler
+	w.mu.Unlock()
+	if d <= 0 || h == nil {
+		return
+	}
+	if latency := w.clock.Now().Sub(t.added); latency > d {
+		h(latency)
+	}
+}
+
+// checkSlow calls the slow call handler if the function started at the start
+// time ran longer than the slow call threshold.
+func (w *Waiter) checkSlow(start time.Time) {
+	w.mu.Lock()
+	d, h := w.slow, w.slowHandler
+	w.mu.Unlock()
+	if d <= 0 || h == nil {
+		return
+	}
+	if duration := w.clock.Now().Sub(start); duration > d {
+		h(duration)
+	}
+}
+
+// reject passes the task function, which is not called because of err, to
+// the reject handler. The cancelled tasks are not passed.
+func (w *Waiter) reject(t task, err error) {
+	w.mu.Lock()
+	h := w.rejectHandler
+	w.mu.Unlock()
+
+	if t.cancelled() {
+		return
+	}
+	w.logf("waiter: function rejected: %v", err)
+	if h != nil {
+		h(t.fn)
+	}
+}
+
+// drop removes the task, which is dropped without calling it, from the
+// pending tasks, and releases the caller waiting for the task with err.
+func (w *Waiter) drop(t task, err error) {
+	if t.result != nil && t.claim() {
+		t.result <- err
+	}
+	w.skip(t)
+}
+
+// skip removes the task, which is not called, from the pending tasks.
+func (w *Waiter) skip(t task) {
+	w.releaseKey(t)
+	w.donePending()
+}
+
+// donePending removes the called or skipped task from the pending tasks and
+// calls the empty queue handler if it was the last pending one.
+func (w *Waiter) donePending() {
+	if w.addPending(-1) {
+		w.notifyEmpty()
+	}
+}
+
+// coalesced returns true if the task must be skipped in coalesce mode: the
+// last called task had the same key and was called after the task was added.
+func (w *Waiter) coalesced(t task) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.coalesce && t.key != "" && t.key == w.lastKey &&
+		!t.added.After(w.lastKeyAt)
+}
+
+// releaseKey removes the task key from the keys of pending tasks.
+func (w *Waiter) releaseKey(t task) {
+	if t.key == "" {
+		return
+	}
+	w.mu.Lock()
+	delete(w.keys, t.key)
+	w.mu.Unlock()
+}
+
+// execute calls the task function and updates the Waiter counters.
+func (w *Waiter) execute(t task) {
+	// Send the call time to the events channel if there is room
+	now := w.clock.Now()
+	w.stats.addCall(now)
+	select {
+	case w.events <- now:
+	default:
+	}
+
+	// Allow to add a new function with the same key
+	w.releaseKey(t)
+	if t.key != "" {
+		w.mu.Lock()
+		w.lastKey, w.lastKeyAt = t.key, now
+		w.mu.Unlock()
+	}
+
+	if t.fn != nil {
+		w.call(t.fn)
+		w.checkSlow(now)
+	}
+	w.stats.executed.Add(1)
+	w.donePending()
+}
+
+// notifyEmpty calls the empty queue handler set with OnEmpty.
+func (w *Waiter) notifyEmpty() {
+	w.mu.Lock()
+	h := w.emptyHandler
+	w.mu.Unlock()
+	if h != nil {
+		h()
+	}
+}
+
+// notifyHighWater calls the high water handler set with SetOnHighWater.
+func (w *Waiter) notifyHighWater(depth int) {
+	w.mu.Lock()
+	h := w.highWaterHandler
+	w.mu.Unlock()
+	if h != nil {
+		h(depth)
+	}
+}
+
+// call calls the specified function and recovers from its panic.
+func (w *Waiter) call(fn func()) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		// Pass the panic value to the panic handler
+		w.logf("waiter: recovered from panic: %v", r)
+		w.mu.Lock()
+		h := w.panicHandler
+		w.mu.Unlock()
+		if h != nil {
+			h(r)
+			return
+		}
+		fmt.Fprintln(os.Stderr, "waiter: recovered from panic:", r)
+	}()
+	fn()
+}
+
+// wait waits the specified delay time since the last call before calling the
+// next task function. If the task delay is zero, the Waiter delay is used. It
+// returns the error if the task must be dropped without calling it.
+func (w *Waiter) wait(t task) error {
+	// Wait until the pause is over
+	w.mu.Lock()
+	pause := w.pauseUntil.Sub(w.clock.Now())
+	w.mu.Unlock()
+	if pause > 0 {
+		w.sleep(pause)
+	}
+	w.waitResume()
+
+	// Call the task without delay if the rate limit is disabled
+	w.mu.Lock()
+	if w.disabled {
+		w.last = w.clock.Now()
+		w.mu.Unlock()
+		w.notifyWait(0)
+		return nil
+	}
+	w.mu.Unlock()
+
+	units := t.units()
+	switch {
+	case len(w.chain) > 0:
+		// Wait the turn in all the chain Waiters
+		if !w.waitChain() {
+			return ErrWaiterClosed
+		}
+		return nil
+	case units == 0:
+		// Call the free task without delay
+		w.notifyWait(0)
+		return nil
+	case w.burst > 1:
+		// Use the token bucket if the Waiter allows bursts
+		w.waitToken(units)
+		return nil
+	case w.maxLag > 0:
+		// Use the leaky bucket schedule if the lag is limited
+		if !w.waitLeaky(t) {
+			return ErrDropped
+		}
+		return nil
+	case w.windowMax > 0:
+		// Use the fixed window counter if the calls per window are limited
+		w.waitWindow(units)
+		return nil
+	}
+
+	// Sleep until the delay since the last call elapses. If the delay changes
+	// during the sleep, the time to sleep is recalculated with the new delay
+	extra := t.extra()
+	for i := 0; ; i++ {
+		// Get the delay between calls multiplied by the task cost
+		w.mu.Lock()
+		changed := w.delayChanged
+		w.mu.Unlock()
+		delay := t.delay
+		if delay == 0 {
+			delay = w.jitteredDelay()
+		}
+		delay = delay*time.Duration(units) + extra
+
+		// Calculate the time to sleep since the last call. If the last call
+		// time is zero, the function is called without delay
+		w.mu.Lock()
+		var sleep time.Duration
+		if !w.last.IsZero() {
+			sleep = delay - w.clock.Now().Sub(w.last)
+		}
+		w.mu.Unlock()
+
+		// If the elapsed time is less than the delay, sleep for the
+		// difference
+		sleep = max(sleep, 0)
+		if i == 0 {
+			w.notifyWait(sleep)
+		}
+		if sleep == 0 || w.sleepOr(sleep, changed) || w.stop.Load() {
+			break
+		}
+	}
+
+	// Update the last call time, unless the task was cancelled during the
+	// wait, so the skipped task does not take the turn of the next one
+	if t.cancelled() {
+		return nil
+	}
+	w.mu.Lock()
+	w.last = w.clock.Now()
+	w.mu.Unlock()
+	return nil
+}
+
+// waitLeaky waits until the scheduled time of the task in leaky bucket mode.
+// It returns false if the task is late for more than maxLag and must be
+// dropped.
+func (w *Waiter) waitLeaky(t task) bool {
+	w.mu.Lock()
+
+	// The task is scheduled after the previous one, but not before it was
+	// added to the queue
+	now := w.clock.Now()
+	if w.schedule.Before(t.added) {
+		w.schedule = t.added
+	}
+	rate := t.delay
+	if rate == 0 {
+		rate = w.delay
+	}
+	rate = rate*time.Duration(t.units()) + t.extra()
+
+	// Check the lag for the schedule
+	if now.Sub(w.schedule) > w.maxLag {
+		if w.lagPolicy == LagDrop {
+			w.schedule = w.schedule.Add(rate)
+			w.mu.Unlock()
+			return false
+		}
+		w.schedule = now
+	}
+
+	// Wait until the scheduled time and schedule the next call
+	sleep := w.schedule.Sub(now)
+	w.last = w.schedule
+	w.schedule = w.schedule.Add(rate)
+	w.mu.Unlock()
+
+	sleep = max(sleep, 0)
+	w.notifyWait(sleep)
+	if sleep > 0 {
+		w.sleep(sleep)
+	}
+	return true
+}
+
+// waitGate waits until the gate set with SetGate is open or the Waiter is
+// stopped.
+func (w *Waiter) waitGate() {
+	for {
+		w.mu.Lock()
+		gate := w.gate
+		w.mu.Unlock()
+		if gate == nil || w.stop.Load() || gate() {
+			return
+		}
+		<-w.clock.After(gatePoll)
+	}
+}
+
+// acquire takes a slot of the concurrency limit set with NewLimited, waiting
+// until one of the executing functions returns. It returns false if the
+// worker is stopped while waiting.
+func (w *Waiter) acquire() bool {
+	if w.sem == nil {
+		return true
+	}
+
+	w.mu.Lock()
+	halt := w.halt
+	w.mu.Unlock()
+	select {
+	case w.sem <- struct{}{}:
+		return true
+	case <-halt:
+		return false
+	}
+}
+
+// release releases the slot of the concurrency limit taken with acquire.
+func (w *Waiter) release() {
+	if w.sem != nil {
+		<-w.sem
+	}
+}
+
+// notifyWait calls the before wait handler with the time to sleep.
+func (w *Waiter) notifyWait(sleep time.Duration) {
+	w.mu.Lock()
+	h := w.beforeWait
+	w.mu.Unlock()
+	if h != nil {
+		h(sleep)
+	}
+}
+
+// waitChain waits the turn in all the chain Waiters one by one. It returns
+// false if a chain Waiter is closed, or the worker is stopped while waiting.
+// The wait of the stopped worker is cancelled, so it does not take the turns
+// of the chain Waiters.
+func (w *Waiter) waitChain() bool {
+	// Cancel the wait when the worker is stopped
+	w.mu.Lock()
+	halt := w.halt
+	w.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-halt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, s := range w.chain {
+		if s.WaitContext(ctx, nil) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// waitWindow waits until n calls are available in the current window in fixed
+// window mode and takes them.
+func (w *Waiter) waitWindow(n int) {
+	w.mu.Lock()
+
+	// Start a new window if the current one is over
+	now := w.clock.Now()
+	if w.windowStart.IsZero() || now.Sub(w.windowStart) >= w.delay {
+		w.windowStart, w.windowCalls = now, 0
+	}
+
+	// Wait until the next window if the current one is full
+	var sleep time.Duration
+	if w.windowCalls > 0 && w.windowCalls+n > w.windowMax {
+		sleep = w.windowStart.Add(w.delay).Sub(now)
+		w.windowStart, w.windowCalls = w.windowStart.Add(w.delay), 0
+	}
+	w.windowCalls += n
+	w.last = now.Add(sleep)
+	w.mu.Unlock()
+
+	w.notifyWait(sleep)
+	if sleep > 0 {
+		w.sleep(sleep)
+	}
+}
+
+// jitteredDelay returns the delay, or the delay of the schedule if it is set,
+// randomized with the jitter fraction.
+func (w *Waiter) jitteredDelay() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delay := w.delay
+	if w.delaySchedule != nil {
+		delay = w.delaySchedule(w.clock.Now())
+	}
+	if w.jitter == 0 {
+		return delay
+	}
+	return delay + time.Duration(float64(delay)*w.jitter*(2*rand.Float64()-1))
+}
+
+// waitToken waits until n tokens are available in the token bucket and takes
+// them.
+func (w *Waiter) waitToken(n int) {
+	w.mu.Lock()
+
+	// Add tokens for the time elapsed since the last call
+	now := w.clock.Now()
+	if w.delay > 0 {
+		w.tokens += float64(now.Sub(w.last)) / float64(w.delay)
+	}
+	if w.delay <= 0 || w.tokens > float64(w.burst) {
+		w.tokens = float64(w.burst)
+	}
+	w.last = now
+
+	// If there are enough tokens in the bucket, take them and return
+	if w.tokens >= float64(n) {
+		w.tokens -= float64(n)
+		w.mu.Unlock()
+		w.notifyWait(0)
+		return
+	}
+
+	// Wait until the missing tokens are added and take them
+	sleep := time.Duration((float64(n) - w.tokens) * float64(w.delay))
+	w.tokens = 0
+	w.last = now.Add(sleep)
+	w.mu.Unlock()
 
-	// Update the last call time
-	w.last = time.Now()
+	w.notifyWait(sleep)
+	w.sleep(sleep)
 }
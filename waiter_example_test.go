@@ -74,7 +74,7 @@ func ExampleNew() {
 
 	// Create a waiter using the New function
 	w := New(100*time.Millisecond, 10)
-	fmt.Println("waiter created", w.delay)
+	fmt.Println("waiter created", w.Delay())
 
 	// Output:
 	// waiter created 100ms
@@ -87,7 +87,7 @@ func ExampleRateLimit() {
 
 	// Create a waiter using the RateLimit function
 	w := New(RateLimit(100, 1*time.Second), 10)
-	fmt.Println("waiter created", w.delay)
+	fmt.Println("waiter created", w.Delay())
 
 	// Output:
 	// waiter created 10ms
@@ -155,3 +155,60 @@ func ExampleWaiter_Len() {
 	// Output:
 	// len = 0
 }
+
+// ExampleWaiter_Cap calls the Waiter.Cap function.
+//
+// This code demonstrates the usage of the Waiter.Cap function. It creates a
+// new Waiter with a 100ms delay and a queue length of 10, and then prints the
+// capacity of the waiter's queue, which is 10.
+func ExampleWaiter_Cap() {
+
+	// Create a waiter
+	w := New(100*time.Millisecond, 10)
+
+	// Call the Waiter.Cap function
+	fmt.Println("cap =", w.Cap())
+
+	// Output:
+	// cap = 10
+}
+
+// ExampleWaiter_Closed calls the Waiter.Closed function.
+//
+// This code demonstrates the usage of the Waiter.Closed function. It creates a
+// new Waiter, and prints its closed state before and after the Waiter.Close
+// function call.
+func ExampleWaiter_Closed() {
+
+	// Create a waiter
+	w := New(100*time.Millisecond, 10)
+	fmt.Println("closed =", w.Closed())
+
+	// Close the waiter
+	w.Close()
+	fmt.Println("closed =", w.Closed())
+
+	// Output:
+	// closed = false
+	// closed = true
+}
+
+// ExampleWaiter_Delay calls the Waiter.Delay function.
+//
+// This code demonstrates the usage of the Waiter.Delay function. It creates a
+// new Waiter with a delay of 100 calls per second, and prints the delay read
+// back from the Waiter before and after the Waiter.SetDelay function call.
+func ExampleWaiter_Delay() {
+
+	// Create a waiter
+	w := New(RateLimit(100, time.Second), 10)
+	fmt.Println("delay =", w.Delay())
+
+	// Change the delay
+	w.SetDelay(50 * time.Millisecond)
+	fmt.Println("delay =", w.Delay())
+
+	// Output:
+	// delay = 10ms
+	// delay = 50ms
+}
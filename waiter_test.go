@@ -1,7 +1,15 @@
 package waiter
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -84,3 +92,2578 @@ func TestCall(t *testing.T) {
 	total := time.Since(start)
 	t.Log("done, total time", total)
 }
+
+func TestTryCall(t *testing.T) {
+	w := New(time.Second, 1)
+	defer w.Close()
+
+	// Fill the queue, the worker is sleeping on the first function so the
+	// queue becomes full after one or two calls
+	var err error
+	for range 3 {
+		if err = w.TryCall(func() {}); err != nil {
+			break
+		}
+	}
+	if err != ErrQueueFull {
+		t.Errorf("err=%v, want %v", err, ErrQueueFull)
+	}
+
+	w.Close()
+	if err = w.TryCall(func() {}); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
+
+func TestSetDelay(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	w.SetDelay(20 * time.Millisecond)
+	if d := w.Delay(); d != 20*time.Millisecond {
+		t.Fatalf("delay=%v, want 20ms", d)
+	}
+
+	// The second call should be executed with the new delay
+	start := time.Now()
+	w.Wait(nil)
+	w.Wait(nil)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("elapsed=%v, want < 1s", elapsed)
+	}
+}
+
+func TestSetDelayDuringWait(t *testing.T) {
+	w := New(5*time.Second, 10)
+	defer w.Close()
+
+	// The function waiting the long delay is called soon after the delay is
+	// shortened
+	start := time.Now()
+	done := make(chan struct{})
+	w.Call(func() { close(done) })
+	time.Sleep(20 * time.Millisecond)
+	w.SetDelay(50 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("function is not called after the delay is shortened")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("elapsed=%v, want >= 50ms", elapsed)
+	}
+}
+
+func TestWaitErr(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	errTest := errors.New("test error")
+	if err := w.WaitErr(func() error { return errTest }); err != errTest {
+		t.Errorf("err=%v, want %v", err, errTest)
+	}
+	if err := w.WaitErr(func() error { return nil }); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+
+	w.Close()
+	if err := w.WaitErr(func() error { return nil }); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
+
+func TestWaitDiscarded(t *testing.T) {
+	w := New(time.Second, 10)
+
+	// The queued function discarded by Close releases its caller
+	w.Call(func() {})
+	w.Call(func() {})
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Wait(func() {}) }()
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	select {
+	case err := <-errCh:
+		if err != ErrWaiterClosed {
+			t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait is not released by close")
+	}
+}
+
+func TestCallResult(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	res, err := CallResult(w, func() (int, error) { return 42, nil })
+	if err != nil || res != 42 {
+		t.Errorf("res=%v, err=%v, want 42, nil", res, err)
+	}
+
+	w.Close()
+	res, err = CallResult(w, func() (int, error) { return 42, nil })
+	if err != ErrWaiterClosed || res != 0 {
+		t.Errorf("res=%v, err=%v, want 0, %v", res, err, ErrWaiterClosed)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	// The function gets the context and returns the typed result
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	res, err := Submit(ctx, w, func(ctx context.Context) (string, error) {
+		return ctx.Value(key{}).(string), nil
+	})
+	if err != nil || res != "value" {
+		t.Errorf("res=%q, err=%v, want value, nil", res, err)
+	}
+
+	// The function error is returned with its result
+	errTest := errors.New("test error")
+	n, err := Submit(ctx, w, func(context.Context) (int, error) {
+		return 1, errTest
+	})
+	if err != errTest || n != 1 {
+		t.Errorf("res=%v, err=%v, want 1, %v", n, err, errTest)
+	}
+}
+
+func TestSubmitCancel(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	// The context is done before the function is called, so it is skipped
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var called atomic.Bool
+	res, err := Submit(ctx, w, func(context.Context) (int, error) {
+		called.Store(true)
+		return 42, nil
+	})
+	if err != context.DeadlineExceeded || res != 0 {
+		t.Errorf("res=%v, err=%v, want 0, %v", res, err, context.DeadlineExceeded)
+	}
+	w.Flush()
+	if called.Load() {
+		t.Error("the cancelled function is called")
+	}
+}
+
+func TestNewBurst(t *testing.T) {
+	w := NewBurst(100*time.Millisecond, 10, 3)
+	defer w.Close()
+
+	// The first burst calls are executed without delay
+	start := time.Now()
+	for range 3 {
+		w.Wait(nil)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("burst elapsed=%v, want < 50ms", elapsed)
+	}
+
+	// The next call waits for a new token
+	w.Wait(nil)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("elapsed=%v, want >= 90ms", elapsed)
+	}
+}
+
+func TestCloseAndWait(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	var called atomic.Int32
+	for range 5 {
+		w.Call(func() { called.Add(1) })
+	}
+
+	if err := w.CloseAndWait(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+	if n := called.Load(); n != 5 {
+		t.Errorf("called=%d, want 5", n)
+	}
+
+	if err := w.Call(func() {}); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+	if err := w.CloseAndWait(); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	panicCh := make(chan any, 1)
+	w.SetPanicHandler(func(r any) { panicCh <- r })
+
+	// Schedule a panicking function followed by a normal one
+	w.Call(func() { panic("test panic") })
+	var called bool
+	if err := w.Wait(func() { called = true }); err != nil || !called {
+		t.Fatalf("called=%v, err=%v, want true, nil", called, err)
+	}
+
+	if r := <-panicCh; r != "test panic" {
+		t.Errorf("panic=%v, want test panic", r)
+	}
+
+	// The caller waiting for the panicking function is released
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Wait(func() { panic("wait panic") }) }()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrPanic) {
+			t.Errorf("err=%v, want %v", err, ErrPanic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait is not released by the panic")
+	}
+	if r := <-panicCh; r != "wait panic" {
+		t.Errorf("panic=%v, want wait panic", r)
+	}
+	go func() {
+		errCh <- w.WaitContext(context.Background(), func() { panic("ctx panic") })
+	}()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrPanic) {
+			t.Errorf("err=%v, want %v", err, ErrPanic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait context is not released by the panic")
+	}
+	<-panicCh
+}
+
+func TestNewWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewWithContext(ctx, 10*time.Millisecond, 10)
+
+	if err := w.Wait(nil); err != nil {
+		t.Fatalf("err=%v, want nil", err)
+	}
+
+	// Cancel the context and wait until the worker exits
+	cancel()
+	<-w.stopped
+
+	if err := w.Call(func() {}); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
+
+func TestSetJitter(t *testing.T) {
+	w := New(100*time.Millisecond, 10)
+	defer w.Close()
+
+	// The fraction is clamped to [0, 1]
+	w.SetJitter(2)
+	if w.jitter != 1 {
+		t.Errorf("jitter=%v, want 1", w.jitter)
+	}
+
+	w.SetJitter(0.5)
+	for range 100 {
+		d := w.jitteredDelay()
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("delay=%v, want in range [50ms, 150ms]", d)
+		}
+	}
+
+	// The zero fraction reproduces the delay exactly
+	w.SetJitter(0)
+	if d := w.jitteredDelay(); d != 100*time.Millisecond {
+		t.Errorf("delay=%v, want 100ms", d)
+	}
+}
+
+func TestCallAfter(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	w.Wait(nil)
+
+	// The call waits its own delay instead of the Waiter delay
+	start := time.Now()
+	done := make(chan struct{})
+	w.CallAfter(100*time.Millisecond, func() { close(done) })
+	<-done
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("elapsed=%v, want >= 90ms", elapsed)
+	}
+}
+
+func TestCallJittered(t *testing.T) {
+	const delay, maxExtra = 20 * time.Millisecond, 30 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	w.Wait(nil)
+
+	// Each jittered call waits the delay plus up to maxExtra
+	for range 5 {
+		start := time.Now()
+		done := make(chan struct{})
+		w.CallJittered(maxExtra, func() { close(done) })
+		<-done
+		elapsed := time.Since(start)
+		if elapsed < delay-2*time.Millisecond || elapsed > delay+maxExtra+20*time.Millisecond {
+			t.Errorf("elapsed=%v, want in range [%v, %v]", elapsed, delay,
+				delay+maxExtra)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	var called atomic.Int32
+	for range 5 {
+		w.Call(func() { called.Add(1) })
+	}
+
+	if n := w.Flush(); n == 0 || n > 5 {
+		t.Errorf("flushed=%d, want in range [1, 5]", n)
+	}
+	if l, c := w.Len(), called.Load(); l != 0 || c != 5 {
+		t.Errorf("len=%d, called=%d, want 0, 5", l, c)
+	}
+
+	// The Waiter is still open after Flush
+	if err := w.Wait(nil); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+}
+
+func TestNewPool(t *testing.T) {
+	w := NewPool(10*time.Millisecond, 10, 5)
+
+	// The slow functions are executed concurrently by the workers
+	start := time.Now()
+	var called atomic.Int32
+	for range 5 {
+		w.Call(func() {
+			time.Sleep(100 * time.Millisecond)
+			called.Add(1)
+		})
+	}
+	w.CloseAndWait()
+
+	if n := called.Load(); n != 5 {
+		t.Errorf("called=%d, want 5", n)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("elapsed=%v, want < 400ms", elapsed)
+	}
+}
+
+func TestNewLimited(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := NewLimited(delay, 10, 2)
+
+	// The slow functions are spaced by the delay and no more than two of
+	// them execute at the same time
+	var mu sync.Mutex
+	var starts []time.Time
+	var running, peak int
+	for range 6 {
+		w.Call(func() {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+
+			time.Sleep(100 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	w.CloseAndWait()
+
+	if len(starts) != 6 {
+		t.Fatalf("called=%d, want 6", len(starts))
+	}
+	if peak != 2 {
+		t.Errorf("peak concurrency=%d, want 2", peak)
+	}
+	for i := 1; i < len(starts); i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap < delay-5*time.Millisecond {
+			t.Errorf("call %d gap=%v, want >= %v", i, gap, delay)
+		}
+	}
+
+	// The third function waits until the first one returns
+	if gap := starts[2].Sub(starts[0]); gap < 100*time.Millisecond {
+		t.Errorf("third call after %v, want >= 100ms", gap)
+	}
+}
+
+func TestReset(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	// The next call is executed without delay after Reset
+	w.Reset()
+	start := time.Now()
+	w.Wait(nil)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("elapsed=%v, want < 100ms", elapsed)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	w := New(100*time.Millisecond, 10)
+	defer w.Close()
+
+	// The function is not called within the timeout and is skipped
+	var called atomic.Bool
+	err := w.WaitTimeout(func() { called.Store(true) }, 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Errorf("err=%v, want %v", err, ErrTimeout)
+	}
+
+	// The function is called within the timeout
+	if err = w.WaitTimeout(nil, time.Second); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if called.Load() {
+		t.Error("cancelled function was called")
+	}
+}
+
+func TestSetOnReject(t *testing.T) {
+	w := New(100*time.Millisecond, 10)
+
+	var rejected atomic.Int32
+	w.SetOnReject(func(fn func()) { rejected.Add(1) })
+
+	// The queued functions are discarded by Close
+	for range 3 {
+		w.Call(func() {})
+	}
+	w.Close()
+	<-w.stopped
+
+	// The function is rejected by Call
+	w.Call(func() {})
+
+	if n := rejected.Load(); n != 4 {
+		t.Errorf("rejected=%d, want 4", n)
+	}
+}
+
+func TestResize(t *testing.T) {
+	w := New(time.Second, 2)
+	defer w.Close()
+
+	// Fill the queue
+	for w.TryCall(func() {}) == nil {
+	}
+	l := w.Len()
+
+	// The queue can't be shorter than the number of queued functions
+	if err := w.Resize(l - 1); err != ErrQueueTooShort {
+		t.Errorf("err=%v, want %v", err, ErrQueueTooShort)
+	}
+
+	// The queued functions are kept after resize
+	if err := w.Resize(10); err != nil {
+		t.Fatalf("resize error: %v", err)
+	}
+	if w.Cap() != 10 || w.Len() != l {
+		t.Errorf("cap=%d, len=%d, want 10, %d", w.Cap(), w.Len(), l)
+	}
+	if err := w.TryCall(func() {}); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+}
+
+func TestNewLeaky(t *testing.T) {
+	for _, policy := range []LagPolicy{LagFastForward, LagDrop} {
+		w := NewLeaky(20*time.Millisecond, 10, 30*time.Millisecond, policy)
+
+		// The slow function makes the next calls late for the schedule
+		var called atomic.Int32
+		w.Call(func() { time.Sleep(100 * time.Millisecond) })
+		for range 5 {
+			w.Call(func() { called.Add(1) })
+		}
+		w.CloseAndWait()
+
+		n := called.Load()
+		switch {
+		case policy == LagFastForward && n != 5:
+			t.Errorf("fast forward called=%d, want 5", n)
+		case policy == LagDrop && (n == 0 || n == 5):
+			t.Errorf("drop called=%d, want in range [1, 4]", n)
+		}
+	}
+
+	// The caller waiting for the dropped function is released
+	w := NewLeaky(20*time.Millisecond, 10, 30*time.Millisecond, LagDrop)
+	defer w.Close()
+	w.Call(func() { time.Sleep(100 * time.Millisecond) })
+	errs := make(chan error, 5)
+	for range 5 {
+		go func() { errs <- w.Wait(nil) }()
+	}
+	var dropped int
+	for range 5 {
+		select {
+		case err := <-errs:
+			switch err {
+			case nil:
+			case ErrDropped:
+				dropped++
+			default:
+				t.Errorf("wait err=%v, want nil or %v", err, ErrDropped)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("wait is not released by the drop")
+		}
+	}
+	if dropped == 0 {
+		t.Error("no wait is dropped, want at least one")
+	}
+}
+
+func TestCallBatch(t *testing.T) {
+	w := New(time.Second, 3)
+	defer w.Close()
+
+	// The batch is stopped when the queue is full
+	fns := make([]func(), 10)
+	submitted, err := w.CallBatch(fns)
+	if err != ErrQueueFull || submitted < 3 || submitted > 4 {
+		t.Errorf("submitted=%d, err=%v, want 3 or 4, %v", submitted, err,
+			ErrQueueFull)
+	}
+
+	w.Close()
+	if submitted, err = w.CallBatch(fns); err != ErrWaiterClosed || submitted != 0 {
+		t.Errorf("submitted=%d, err=%v, want 0, %v", submitted, err,
+			ErrWaiterClosed)
+	}
+}
+
+func TestPause(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	// No function is called while the Waiter is paused
+	w.Pause()
+	var mu sync.Mutex
+	var order []int
+	for i := range 3 {
+		w.Call(func() {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+	time.Sleep(5 * delay)
+	if n := w.Len(); n < 2 {
+		t.Errorf("len=%d while paused, want >= 2", n)
+	}
+	mu.Lock()
+	if len(order) != 0 {
+		t.Errorf("called=%d while paused, want 0", len(order))
+	}
+	mu.Unlock()
+
+	// After a long pause Resume calls the first function immediately
+	w.Resume()
+	w.Flush()
+	if want := []int{0, 1, 2}; !slices.Equal(order, want) {
+		t.Errorf("order=%v, want %v", order, want)
+	}
+}
+
+func TestResumeAfterDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	w.Pause()
+	var mu sync.Mutex
+	var calls []time.Time
+	for range 3 {
+		w.Call(func() {
+			mu.Lock()
+			calls = append(calls, time.Now())
+			mu.Unlock()
+		})
+	}
+	time.Sleep(4 * delay)
+
+	// The first function after the long pause waits the full delay, and the
+	// next ones are spaced from it
+	resumed := time.Now()
+	w.ResumeAfterDelay()
+	w.Flush()
+	if len(calls) != 3 {
+		t.Fatalf("called=%d, want 3", len(calls))
+	}
+	prev := resumed
+	for i, c := range calls {
+		if gap := c.Sub(prev); gap < delay-5*time.Millisecond {
+			t.Errorf("call %d gap=%v, want >= %v", i, gap, delay)
+		}
+		prev = c
+	}
+}
+
+func TestAdjustFromHeaders(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	// The delay is the time until reset divided by remaining calls
+	w.AdjustFromHeaders(10, time.Now().Add(time.Second))
+	if d := w.Delay(); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("delay=%v, want about 100ms", d)
+	}
+
+	// No calls are executed until reset if there are no remaining calls
+	w.Reset()
+	start := time.Now()
+	w.AdjustFromHeaders(0, start.Add(100*time.Millisecond))
+	w.Wait(nil)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("elapsed=%v, want >= 90ms", elapsed)
+	}
+}
+
+func TestCallPriority(t *testing.T) {
+	w := New(20*time.Millisecond, 10)
+	defer w.Close()
+
+	var mu sync.Mutex
+	var order []int
+	add := func(priority int) {
+		w.CallPriority(priority, func() {
+			mu.Lock()
+			order = append(order, priority)
+			mu.Unlock()
+		})
+	}
+
+	// The high priority call is added after the low priority ones
+	for range 5 {
+		add(0)
+	}
+	add(1)
+	w.Flush()
+
+	// The first low priority call may be taken by the worker before the high
+	// priority call is added
+	if i := slices.Index(order, 1); i < 0 || i > 1 {
+		t.Errorf("order=%v, want high priority call first or second", order)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		quantity int
+		want     time.Duration
+	}{
+		{100, 10 * time.Millisecond},
+		{1, time.Second},
+		{0, time.Second},
+		{-5, time.Second},
+	} {
+		if d := RateLimit(tt.quantity, time.Second); d != tt.want {
+			t.Errorf("RateLimit(%d)=%v, want %v", tt.quantity, d, tt.want)
+		}
+	}
+}
+
+func TestNewNegativeDelay(t *testing.T) {
+	w := New(-5*time.Millisecond, 10)
+	defer w.Close()
+	if d := w.Delay(); d != 0 {
+		t.Errorf("delay=%v, want 0", d)
+	}
+
+	// The functions are called without waiting
+	start := time.Now()
+	for range 3 {
+		w.Wait(nil)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("elapsed=%v, want < 50ms", elapsed)
+	}
+}
+
+func TestNewNegativeQueueLen(t *testing.T) {
+	w := New(0, -1)
+	defer w.Close()
+	if n := w.Cap(); n != 0 {
+		t.Errorf("cap=%d, want 0", n)
+	}
+
+	// The functions are called as with the unbuffered queue
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Wait(nil) }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("err=%v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait blocks with the negative queue length")
+	}
+}
+
+func TestNewValidated(t *testing.T) {
+	for _, tt := range []struct {
+		delay    time.Duration
+		queueLen int
+	}{
+		{-time.Millisecond, 10},
+		{time.Millisecond, -1},
+	} {
+		w, err := NewValidated(tt.delay, tt.queueLen)
+		if !errors.Is(err, ErrInvalidConfig) || w != nil {
+			t.Errorf("NewValidated(%v, %d) err=%v, want %v", tt.delay,
+				tt.queueLen, err, ErrInvalidConfig)
+		}
+	}
+
+	w, err := NewValidated(0, 0)
+	if err != nil {
+		t.Fatalf("err=%v, want nil", err)
+	}
+	defer w.Close()
+	if err := w.Wait(nil); err != nil {
+		t.Errorf("wait err=%v, want nil", err)
+	}
+}
+
+func TestRatePerSecond(t *testing.T) {
+	w := New(10*time.Millisecond, 1)
+	defer w.Close()
+	if r := w.RatePerSecond(); r != 100 {
+		t.Errorf("rate=%v, want 100", r)
+	}
+
+	// The zero delay does not limit the rate
+	w.SetDelay(0)
+	if r := w.RatePerSecond(); !math.IsInf(r, 1) {
+		t.Errorf("rate=%v, want +Inf", r)
+	}
+}
+
+func TestWaitAll(t *testing.T) {
+	w := New(10*time.Millisecond, 2)
+
+	var called atomic.Int32
+	fn := func() { called.Add(1) }
+	if err := w.WaitAll(fn, fn, fn, fn, fn); err != nil {
+		t.Fatalf("err=%v, want nil", err)
+	}
+	if n := called.Load(); n != 5 {
+		t.Errorf("called=%d, want 5", n)
+	}
+
+	w.Close()
+	if err := w.WaitAll(fn); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+
+	// Close releases WaitAll with the queued functions
+	w = New(200*time.Millisecond, 10)
+	errCh := make(chan error, 1)
+	called.Store(0)
+	go func() { errCh <- w.WaitAll(fn, fn, fn) }()
+	time.Sleep(50 * time.Millisecond)
+	w.Close()
+	select {
+	case err := <-errCh:
+		if err != ErrWaiterClosed {
+			t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitAll is not released by Close")
+	}
+	if n := called.Load(); n > 1 {
+		t.Errorf("called=%d after close, want at most 1", n)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	w := New(100*time.Millisecond, 10)
+	defer w.Close()
+
+	// The function is not called before the context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var called atomic.Bool
+	if err := w.WaitContext(ctx, func() { called.Store(true) }); err != context.DeadlineExceeded {
+		t.Errorf("err=%v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The function is called before the context is done
+	if err := w.WaitContext(context.Background(), nil); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if called.Load() {
+		t.Error("cancelled function was called")
+	}
+}
+
+func TestNextAllowed(t *testing.T) {
+	w := New(100*time.Millisecond, 10)
+	defer w.Close()
+
+	// The first call waits the delay since the Waiter was created
+	if d := w.NextAllowed(); d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("next=%v, want in range (0, 100ms]", d)
+	}
+
+	// The call may proceed immediately after reset
+	w.Reset()
+	if d := w.NextAllowed(); d != 0 {
+		t.Errorf("next=%v, want 0", d)
+	}
+
+	// The disabled Waiter calls the next function immediately
+	w.Wait(nil)
+	w.SetEnabled(false)
+	if d, n := w.NextAllowed(), w.Available(); d != 0 || n != 1 {
+		t.Errorf("next=%v available=%d when disabled, want 0 1", d, n)
+	}
+
+	// The paused Waiter calls nothing until Resume, even when disabled
+	w.Pause()
+	if d, n := w.NextAllowed(), w.Available(); d < time.Hour || n != 0 {
+		t.Errorf("next=%v available=%d when paused, want max 0", d, n)
+	}
+	w.Resume()
+	if d := w.NextAllowed(); d != 0 {
+		t.Errorf("next=%v after resume, want 0", d)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	for range 3 {
+		w.Call(func() {})
+	}
+	w.CloseAndWait()
+
+	// The channel receives the buffered events and then is closed
+	var n int
+	for range w.Events() {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("events=%d, want 3", n)
+	}
+}
+
+func TestCallWithin(t *testing.T) {
+	w := New(time.Second, 1)
+
+	// Fill the queue and wait until the worker takes the first function, so
+	// the queue stays full
+	for w.TryCall(func() {}) == nil {
+	}
+	time.Sleep(10 * time.Millisecond)
+	for w.TryCall(func() {}) == nil {
+	}
+
+	// The function is not added within the wait time
+	start := time.Now()
+	if err := w.CallWithin(func() {}, 20*time.Millisecond); err != ErrQueueFull {
+		t.Errorf("err=%v, want %v", err, ErrQueueFull)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("elapsed=%v, want >= 20ms", elapsed)
+	}
+
+	// The Waiter is closed during the wait
+	time.AfterFunc(20*time.Millisecond, func() { w.Close() })
+	if err := w.CallWithin(func() {}, time.Second); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
+
+func TestCallShared(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	// The concurrent callers with the same key share one call
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (any, error) {
+		calls.Add(1)
+		<-release
+		return "result", nil
+	}
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err, shared := w.CallShared("key", fn)
+			if val != "result" || err != nil || !shared {
+				t.Errorf("val=%v err=%v shared=%t, want result nil true", val,
+					err, shared)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("calls=%d, want 1", n)
+	}
+
+	// The next call with the same key executes again and is not shared
+	val, err, shared := w.CallShared("key", fn)
+	if val != "result" || err != nil || shared || calls.Load() != 2 {
+		t.Errorf("val=%v err=%v shared=%t calls=%d, want result nil false 2",
+			val, err, shared, calls.Load())
+	}
+}
+
+func TestCallSharedPanic(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+	w.SetPanicHandler(func(any) {})
+
+	// The callers with the same key get the panic of the shared call as error
+	release := make(chan struct{})
+	fn := func() (any, error) {
+		<-release
+		panic("shared panic")
+	}
+	errCh := make(chan error, 3)
+	for range 3 {
+		go func() {
+			_, err, _ := w.CallShared("key", fn)
+			errCh <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for range 3 {
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, ErrPanic) {
+				t.Errorf("err=%v, want %v", err, ErrPanic)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("shared call is not released by the panic")
+		}
+	}
+
+	// The next call with the same key executes again
+	val, err, shared := w.CallShared("key", func() (any, error) {
+		return "result", nil
+	})
+	if val != "result" || err != nil || shared {
+		t.Errorf("val=%v err=%v shared=%t, want result nil false", val, err,
+			shared)
+	}
+}
+
+func TestCallKeyed(t *testing.T) {
+	w := New(50*time.Millisecond, 10)
+	defer w.Close()
+
+	// The second call with the same key is ignored while the first is pending
+	var called atomic.Int32
+	fn := func() { called.Add(1) }
+	if err := w.CallKeyed("a", fn); err != nil {
+		t.Fatalf("err=%v, want nil", err)
+	}
+	if err := w.CallKeyed("a", fn); err != ErrDuplicate {
+		t.Errorf("err=%v, want %v", err, ErrDuplicate)
+	}
+	if err := w.CallKeyed("b", fn); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	w.Flush()
+	if n := called.Load(); n != 2 {
+		t.Errorf("called=%d, want 2", n)
+	}
+
+	// The key is released after the function is called
+	if err := w.CallKeyed("a", fn); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+}
+
+func TestNewWithPolicy(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest} {
+		w := NewWithPolicy(time.Millisecond, 3, policy)
+
+		// Block the worker while the queue is filled
+		started, release := make(chan struct{}), make(chan struct{})
+		w.Call(func() { close(started); <-release })
+		<-started
+
+		var mu sync.Mutex
+		var called []int
+		for i := range 6 {
+			err := w.Call(func() {
+				mu.Lock()
+				called = append(called, i)
+				mu.Unlock()
+			})
+			if policy == DropNewest && i >= 3 && err != ErrQueueFull {
+				t.Errorf("call %d err=%v, want %v", i, err, ErrQueueFull)
+			}
+		}
+		close(release)
+		w.CloseAndWait()
+
+		// The queue keeps the first or the last three functions
+		want := []int{0, 1, 2}
+		if policy == DropOldest {
+			want = []int{3, 4, 5}
+		}
+		if !slices.Equal(called, want) {
+			t.Errorf("policy %d called=%v, want %v", policy, called, want)
+		}
+	}
+}
+
+func TestDropOldestReleasesCallers(t *testing.T) {
+	w := NewWithPolicy(200*time.Millisecond, 1, DropOldest)
+	defer w.Close()
+	var rejected atomic.Int32
+	w.SetOnReject(func(fn func()) { rejected.Add(1) })
+
+	// The first function waits the delay in the worker, the second one is
+	// queued and dropped by the third
+	w.Call(func() {})
+	time.Sleep(10 * time.Millisecond)
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Wait(func() {}) }()
+	time.Sleep(10 * time.Millisecond)
+	w.Call(func() {})
+
+	select {
+	case err := <-errCh:
+		if err != ErrDropped {
+			t.Errorf("err=%v, want %v", err, ErrDropped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait is not released by the drop")
+	}
+	if n := rejected.Load(); n != 1 {
+		t.Errorf("rejected=%d, want 1", n)
+	}
+	if s := w.Stats(); s.Rejected != 1 {
+		t.Errorf("stats rejected=%d, want 1", s.Rejected)
+	}
+}
+
+func TestCallArg(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	var sum atomic.Int32
+	for i := 1; i <= 3; i++ {
+		CallArg(w, i, func(i int) { sum.Add(int32(i)) })
+	}
+	w.Flush()
+	if n := sum.Load(); n != 6 {
+		t.Errorf("sum=%d, want 6", n)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	if err := w.Reopen(); err != ErrWaiterOpen {
+		t.Errorf("err=%v, want %v", err, ErrWaiterOpen)
+	}
+
+	// The closed Waiter calls functions again after Reopen
+	w.Close()
+	if err := w.Reopen(); err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	if err := w.Wait(nil); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if d := w.Delay(); d != 10*time.Millisecond {
+		t.Errorf("delay=%v, want 10ms", d)
+	}
+}
+
+func TestCallCost(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	if err := w.CallCost(-1, nil); err != ErrNegativeCost {
+		t.Errorf("err=%v, want %v", err, ErrNegativeCost)
+	}
+
+	// The calls are spaced by the sum of their costs, the first call after
+	// Reset is not delayed
+	w.Reset()
+	start := time.Now()
+	for _, cost := range []int{1, 3, 0, 2} {
+		w.CallCost(cost, nil)
+	}
+	w.Flush()
+	elapsed := time.Since(start)
+	if elapsed < 5*delay || elapsed > 9*delay {
+		t.Errorf("elapsed=%v, want about %v", elapsed, 5*delay)
+	}
+}
+
+func TestCallNow(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	// CallNow runs the function on the calling goroutine after the delay
+	start := time.Now()
+	var called bool
+	w.CallNow(func() { called = true })
+	if !called {
+		t.Fatal("function was not called")
+	}
+	if elapsed := time.Since(start); elapsed < delay/2 {
+		t.Errorf("elapsed=%v, want about %v", elapsed, delay)
+	}
+
+	// CallNow and Call share the rate limit
+	var mu sync.Mutex
+	var times []time.Time
+	add := func() {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}
+	for range 3 {
+		w.Call(add)
+	}
+	for range 3 {
+		w.CallNow(add)
+	}
+	w.Flush()
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < delay*3/4 {
+			t.Errorf("gap %d=%v, want at least %v", i, gap, delay)
+		}
+	}
+}
+
+func TestSetLatencyThreshold(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	w.SetLatencyThreshold(2*delay, func(latency time.Duration) {
+		mu.Lock()
+		latencies = append(latencies, latency)
+		mu.Unlock()
+	})
+
+	// Fill the queue, so the last functions wait longer than the threshold
+	for range 5 {
+		w.Call(func() {})
+	}
+	w.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(latencies) == 0 {
+		t.Fatal("latency handler was not called")
+	}
+	for _, latency := range latencies {
+		if latency <= 2*delay {
+			t.Errorf("latency=%v, want above %v", latency, 2*delay)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	w := New(time.Second, 10)
+
+	// The worker waits the delay before calling the first function
+	for range 5 {
+		w.Call(func() {})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The queued functions are returned and not called
+	fns := w.Drain()
+	if len(fns) != 4 {
+		t.Errorf("drained=%d, want 4", len(fns))
+	}
+	if !w.Closed() {
+		t.Error("waiter is not closed after Drain")
+	}
+	if err := w.Call(func() {}); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+	<-w.stopped
+	if s := w.Stats(); s.Executed != 0 {
+		t.Errorf("executed=%d, want 0", s.Executed)
+	}
+
+	// The caller waiting for the queued function is released and the function
+	// is not returned
+	w = New(time.Second, 10)
+	w.Call(func() {})
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Wait(func() {}) }()
+	time.Sleep(20 * time.Millisecond)
+	if fns := w.Drain(); len(fns) != 0 {
+		t.Errorf("drained=%d, want 0", len(fns))
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrWaiterClosed {
+			t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait is not released by Drain")
+	}
+}
+
+func TestSetDelayBounds(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	if err := w.SetDelayBounds(time.Second, time.Millisecond); err != ErrInvalidBounds {
+		t.Errorf("err=%v, want %v", err, ErrInvalidBounds)
+	}
+
+	// The current delay is clamped by the new bounds
+	if err := w.SetDelayBounds(10*time.Millisecond, 100*time.Millisecond); err != nil {
+		t.Fatalf("set bounds error: %v", err)
+	}
+	if d := w.Delay(); d != 100*time.Millisecond {
+		t.Errorf("delay=%v, want 100ms", d)
+	}
+
+	// The delays set with SetDelay and AdjustFromHeaders are clamped
+	w.SetDelay(0)
+	if d := w.Delay(); d != 10*time.Millisecond {
+		t.Errorf("delay=%v, want 10ms", d)
+	}
+	w.AdjustFromHeaders(1, time.Now().Add(time.Hour))
+	if d := w.Delay(); d != 100*time.Millisecond {
+		t.Errorf("delay=%v, want 100ms", d)
+	}
+}
+
+func TestCallFair(t *testing.T) {
+	w := New(time.Millisecond, 200)
+	defer w.Close()
+
+	// Block the worker until all the functions are added
+	release := make(chan struct{})
+	w.Call(func() { <-release })
+
+	var mu sync.Mutex
+	var order []string
+	add := func(group string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, group)
+			mu.Unlock()
+		}
+	}
+	for range 100 {
+		w.CallFair("A", add("A"))
+	}
+	w.CallFair("B", add("B"))
+	close(release)
+	w.Flush()
+
+	// The B function is called within the first dispatches
+	mu.Lock()
+	defer mu.Unlock()
+	if i := slices.Index(order, "B"); i < 0 || i > 3 {
+		t.Errorf("B position=%d, want at most 3", i)
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	// The disabled Waiter calls functions without delay
+	w.SetEnabled(false)
+	start := time.Now()
+	for range 5 {
+		w.Call(func() {})
+	}
+	w.Flush()
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("elapsed=%v, want less than %v", elapsed, delay)
+	}
+
+	// The enabled Waiter restores the delay
+	w.SetEnabled(true)
+	if d := w.Delay(); d != delay {
+		t.Errorf("delay=%v, want %v", d, delay)
+	}
+	start = time.Now()
+	w.Wait(nil)
+	if elapsed := time.Since(start); elapsed < delay*3/4 {
+		t.Errorf("elapsed=%v, want about %v", elapsed, delay)
+	}
+}
+
+func TestCallTracked(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	// Block the worker, so the functions stay in the queue
+	w.Call(func() {})
+	time.Sleep(10 * time.Millisecond)
+
+	for want := range 3 {
+		position, err := w.CallTracked(func() {})
+		if err != nil {
+			t.Fatalf("call error: %v", err)
+		}
+		if position != want {
+			t.Errorf("position=%d, want %d", position, want)
+		}
+	}
+
+	// The higher priority function is ahead of the others
+	w.CallPriority(1, func() {})
+	if position, _ := w.CallTracked(func() {}); position != 4 {
+		t.Errorf("position=%d, want 4", position)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	var calls atomic.Int32
+	cancel := w.Every(func() { calls.Add(1) })
+	time.Sleep(10*delay + delay/2)
+	cancel()
+	cancel()
+
+	// About one call per delay, and no calls after cancel
+	n := calls.Load()
+	if n < 7 || n > 11 {
+		t.Errorf("calls=%d, want about 10", n)
+	}
+	time.Sleep(3 * delay)
+	if m := calls.Load(); m != n {
+		t.Errorf("calls=%d after cancel, want %d", m, n)
+	}
+
+	// The closed Waiter stops the calls
+	w2 := New(delay, 10)
+	w2.Every(func() {})
+	time.Sleep(delay)
+	w2.Close()
+}
+
+func TestLastCall(t *testing.T) {
+	start := time.Now()
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	// The construction time is returned before the first call
+	if last := w.LastCall(); last.Before(start) || last.After(time.Now()) {
+		t.Errorf("last=%v, want construction time", last)
+	}
+
+	// The last call time is updated by the calls
+	w.Wait(nil)
+	called := time.Now()
+	if last := w.LastCall(); last.Sub(start) < 10*time.Millisecond || last.After(called) {
+		t.Errorf("last=%v, want the call time", last)
+	}
+}
+
+func TestCallRetry(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	// The function fails twice and then succeeds
+	errTest := errors.New("test error")
+	var calls int
+	err := w.CallRetry(5, func() error {
+		if calls++; calls < 3 {
+			return errTest
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("err=%v, calls=%d, want nil, 3", err, calls)
+	}
+
+	// The last error is returned after all the attempts
+	calls = 0
+	err = w.CallRetry(2, func() error { calls++; return errTest })
+	if err != errTest || calls != 2 {
+		t.Errorf("err=%v, calls=%d, want %v, 2", err, calls, errTest)
+	}
+
+	// The function is called once if attempts is less than 1
+	calls = 0
+	w.CallRetry(0, func() error { calls++; return errTest })
+	if calls != 1 {
+		t.Errorf("calls=%d, want 1", calls)
+	}
+
+	// The closed Waiter stops retries
+	w.Close()
+	if err := w.CallRetry(3, func() error { return errTest }); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
+
+func TestStopAt(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := New(delay, 100)
+
+	var calls atomic.Int32
+	w.StopAt(time.Now().Add(5*delay + delay/2))
+	for range 20 {
+		w.Call(func() { calls.Add(1) })
+	}
+	<-w.stopped
+
+	// Only the functions called before the deadline are executed
+	if !w.Closed() {
+		t.Error("waiter is not closed after the deadline")
+	}
+	if n := calls.Load(); n < 3 || n > 6 {
+		t.Errorf("calls=%d, want about 5", n)
+	}
+	if err := w.Call(func() {}); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+
+	// The earlier Close cancels the deadline
+	w.Reopen()
+	w.StopAt(time.Now().Add(delay))
+	w.Close()
+	w.Reopen()
+	time.Sleep(2 * delay)
+	if w.Closed() {
+		t.Error("reopened waiter is closed by the cancelled deadline")
+	}
+	w.Close()
+}
+
+func TestOutstanding(t *testing.T) {
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+
+	// The slow function is outstanding while it runs
+	started := make(chan struct{})
+	release := make(chan struct{})
+	w.Call(func() { close(started); <-release })
+	<-started
+	if l, n := w.Len(), w.Outstanding(); l != 0 || n != 1 {
+		t.Errorf("len=%d, outstanding=%d, want 0, 1", l, n)
+	}
+
+	// The queued functions are outstanding too
+	w.Call(func() {})
+	if n := w.Outstanding(); n != 2 {
+		t.Errorf("outstanding=%d, want 2", n)
+	}
+	close(release)
+	w.Flush()
+	if n := w.Outstanding(); n != 0 {
+		t.Errorf("outstanding=%d after Flush, want 0", n)
+	}
+}
+
+func TestOutstandingAfterReopen(t *testing.T) {
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+
+	// The callers add functions while the Waiter is closed, so some of the
+	// sends fail
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				w.TryCall(func() {})
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	w.Close()
+	wg.Wait()
+	<-w.stopped
+
+	// The pending functions are the functions left in the queue
+	if n, l := w.Outstanding(), w.Len(); n != l {
+		t.Errorf("outstanding=%d, want %d queued", n, l)
+	}
+
+	// After Reopen Flush waits for the new functions
+	if err := w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	var called atomic.Bool
+	w.Call(func() { time.Sleep(20 * time.Millisecond); called.Store(true) })
+	w.Flush()
+	if !called.Load() {
+		t.Error("flush returned before the function is called")
+	}
+	if n := w.Outstanding(); n != 0 {
+		t.Errorf("outstanding=%d after flush, want 0", n)
+	}
+}
+
+func TestSetBeforeWait(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	sleeps := make(chan time.Duration, 10)
+	w.SetBeforeWait(func(sleep time.Duration) { sleeps <- sleep })
+
+	// The worker sleeps about the delay after the previous call
+	w.Wait(nil)
+	<-sleeps
+	w.Wait(nil)
+	if sleep := <-sleeps; sleep < delay*3/4 || sleep > delay {
+		t.Errorf("sleep=%v, want about %v", sleep, delay)
+	}
+
+	// The worker does not sleep if the delay has elapsed
+	time.Sleep(delay)
+	w.Wait(nil)
+	if sleep := <-sleeps; sleep != 0 {
+		t.Errorf("sleep=%v, want 0", sleep)
+	}
+}
+
+func TestNewWindow(t *testing.T) {
+	const window = 100 * time.Millisecond
+	w := NewWindow(window, 3, 10)
+	defer w.Close()
+
+	start := time.Now()
+	var mu sync.Mutex
+	var times []time.Duration
+	for range 6 {
+		w.Call(func() {
+			mu.Lock()
+			times = append(times, time.Since(start))
+			mu.Unlock()
+		})
+	}
+	w.Flush()
+
+	// Three functions are called in each of two windows
+	mu.Lock()
+	defer mu.Unlock()
+	for i, d := range times {
+		want := time.Duration(i/3) * window
+		if d < want-window/4 || d > want+window/2 {
+			t.Errorf("call %d at %v, want about %v", i, d, want)
+		}
+	}
+}
+
+func TestCloseWakesCallers(t *testing.T) {
+	w := New(time.Second, 1)
+
+	// Fill the queue while the worker waits the delay, so the next Call
+	// blocks
+	for w.TryCall(func() {}) == nil {
+	}
+	time.Sleep(10 * time.Millisecond)
+	for w.TryCall(func() {}) == nil {
+	}
+	errCh := make(chan error)
+	go func() { errCh <- w.Call(func() {}) }()
+	time.Sleep(10 * time.Millisecond)
+
+	// Close wakes up the blocked caller
+	w.Close()
+	select {
+	case err := <-errCh:
+		if err != ErrWaiterClosed {
+			t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Call was not woken up by Close")
+	}
+}
+
+func TestString(t *testing.T) {
+	w := New(100*time.Millisecond, 10)
+	if s, want := w.String(), "Waiter{delay=100ms, queued=0/10, policy=Block, burst=1, closed=false}"; s != want {
+		t.Errorf("string=%q, want %q", s, want)
+	}
+	w.Close()
+	if s, want := w.String(), "Waiter{delay=100ms, queued=0/10, policy=Block, burst=1, closed=true}"; s != want {
+		t.Errorf("string=%q, want %q", s, want)
+	}
+}
+
+func TestPolicyAndBurst(t *testing.T) {
+	w := NewWithPolicy(time.Millisecond, 10, DropOldest)
+	defer w.Close()
+	if p := w.Policy(); p != DropOldest {
+		t.Errorf("policy=%v, want %v", p, DropOldest)
+	}
+	if b := w.Burst(); b != 1 {
+		t.Errorf("burst=%d, want 1", b)
+	}
+
+	w2 := NewBurst(time.Millisecond, 10, 5)
+	defer w2.Close()
+	if p, b := w2.Policy(), w2.Burst(); p != Block || b != 5 {
+		t.Errorf("policy=%v burst=%d, want %v 5", p, b, Block)
+	}
+	if s, want := w2.String(), "Waiter{delay=1ms, queued=0/10, policy=Block, burst=5, closed=false}"; s != want {
+		t.Errorf("string=%q, want %q", s, want)
+	}
+	if s := OverflowPolicy(7).String(); s != "OverflowPolicy(7)" {
+		t.Errorf("policy string=%q, want OverflowPolicy(7)", s)
+	}
+}
+
+func TestDone(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	done := w.Done()
+	select {
+	case <-done:
+		t.Fatal("done is closed before Close")
+	default:
+	}
+
+	w.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("done is not closed after Close")
+	}
+
+	// The reopened Waiter has a new done channel
+	w.Reopen()
+	defer w.Close()
+	select {
+	case <-w.Done():
+		t.Error("done is closed after Reopen")
+	default:
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	w := New(0, 10)
+	defer w.Close()
+
+	// The signals do nothing without backoff
+	w.SignalThrottled()
+	if d := w.Delay(); d != 0 {
+		t.Errorf("delay=%v, want 0", d)
+	}
+
+	// The delay grows up to the maximum on throttle signals
+	w.Backoff(10*time.Millisecond, 100*time.Millisecond, 2)
+	var delays []time.Duration
+	for range 5 {
+		w.SignalThrottled()
+		delays = append(delays, w.Delay())
+	}
+	ms := time.Millisecond
+	want := []time.Duration{20 * ms, 40 * ms, 80 * ms, 100 * ms, 100 * ms}
+	if !slices.Equal(delays, want) {
+		t.Errorf("delays=%v, want %v", delays, want)
+	}
+
+	// The delay shrinks down to the minimum on OK signals
+	delays = delays[:0]
+	for range 5 {
+		w.SignalOK()
+		delays = append(delays, w.Delay())
+	}
+	want = []time.Duration{50 * ms, 25 * ms, 12500 * time.Microsecond, 10 * ms, 10 * ms}
+	if !slices.Equal(delays, want) {
+		t.Errorf("delays=%v, want %v", delays, want)
+	}
+}
+
+func TestCallDone(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+
+	// The done function is called after fn
+	var order []string
+	finished := make(chan struct{})
+	err := w.CallDone(
+		func() { order = append(order, "fn") },
+		func() { order = append(order, "done"); close(finished) },
+	)
+	if err != nil {
+		t.Fatalf("call error: %v", err)
+	}
+	<-finished
+	if !slices.Equal(order, []string{"fn", "done"}) {
+		t.Errorf("order=%v, want [fn done]", order)
+	}
+
+	// The done function is not called if the Waiter is closed
+	w.Close()
+	var called bool
+	if err := w.CallDone(func() {}, func() { called = true }); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+	if called {
+		t.Error("done is called for the rejected function")
+	}
+}
+
+func TestSetSlowCallThreshold(t *testing.T) {
+	const slow = 20 * time.Millisecond
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+
+	durations := make(chan time.Duration, 10)
+	w.SetSlowCallThreshold(slow, func(d time.Duration) { durations <- d })
+
+	// The fast function does not fire the handler, the slow one does
+	w.Call(func() {})
+	w.Call(func() { time.Sleep(2 * slow) })
+	w.Flush()
+	close(durations)
+
+	var n int
+	for d := range durations {
+		n++
+		if d < 2*slow {
+			t.Errorf("duration=%v, want at least %v", d, 2*slow)
+		}
+	}
+	if n != 1 {
+		t.Errorf("handler calls=%d, want 1", n)
+	}
+}
+
+func TestCallLoop(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	// The function returns true 3 times then false
+	var calls atomic.Int32
+	w.CallLoop(func() bool { return calls.Add(1) < 4 })
+	time.Sleep(100 * time.Millisecond)
+	if n := calls.Load(); n != 4 {
+		t.Errorf("calls=%d, want 4", n)
+	}
+
+	// The cancel function stops the loop
+	calls.Store(0)
+	cancel := w.CallLoop(func() bool { calls.Add(1); return true })
+	time.Sleep(35 * time.Millisecond)
+	cancel()
+	time.Sleep(15 * time.Millisecond)
+	n := calls.Load()
+	time.Sleep(30 * time.Millisecond)
+	if m := calls.Load(); m != n {
+		t.Errorf("calls=%d after cancel, want %d", m, n)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+
+	// Add functions, change and read the Waiter state from many goroutines
+	// while the worker calls the functions. Run with -race to check the
+	// Waiter state access is synchronized
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 10 {
+				w.Call(func() {})
+				w.SetDelay(time.Duration(i+j) * 100 * time.Microsecond)
+				_ = w.Delay()
+				_ = w.LastCall()
+				_ = w.NextAllowed()
+				_ = w.String()
+			}
+		}()
+	}
+	wg.Wait()
+	w.Flush()
+
+	if s := w.Stats(); s.Executed != 40 {
+		t.Errorf("executed=%d, want 40", s.Executed)
+	}
+}
+
+func TestCallCancelable(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	var mu sync.Mutex
+	var called []int
+	cancels := make([]func(), 3)
+	for i := range cancels {
+		cancel, err := w.CallCancelable(func() {
+			mu.Lock()
+			called = append(called, i)
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatalf("call error: %v", err)
+		}
+		cancels[i] = cancel
+	}
+
+	// Only the functions which are not cancelled are called
+	cancels[1]()
+	cancels[1]()
+	w.Flush()
+	cancels[0]()
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(called, []int{0, 2}) {
+		t.Errorf("called=%v, want [0 2]", called)
+	}
+}
+
+func TestWaitOrFull(t *testing.T) {
+	w := New(50*time.Millisecond, 1)
+	defer w.Close()
+
+	// The function is called if there is room in the queue
+	var called bool
+	if err := w.WaitOrFull(func() { called = true }); err != nil || !called {
+		t.Errorf("err=%v, called=%v, want nil, true", err, called)
+	}
+
+	// The full queue returns ErrQueueFull immediately
+	for w.TryCall(func() {}) == nil {
+	}
+	time.Sleep(10 * time.Millisecond)
+	for w.TryCall(func() {}) == nil {
+	}
+	start := time.Now()
+	if err := w.WaitOrFull(func() {}); err != ErrQueueFull {
+		t.Errorf("err=%v, want %v", err, ErrQueueFull)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("elapsed=%v, want no wait", elapsed)
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := NewBurst(delay, 10, 3)
+	defer w.Close()
+
+	// The burst takes all the tokens
+	for range 3 {
+		w.Wait(nil)
+	}
+	if n := w.Available(); n != 0 {
+		t.Errorf("available=%d, want 0", n)
+	}
+
+	// The paused Waiter has no tokens available and the disabled one has the
+	// full burst
+	w.Pause()
+	if n := w.Available(); n != 0 {
+		t.Errorf("available=%d when paused, want 0", n)
+	}
+	w.Resume()
+	w.SetEnabled(false)
+	if n := w.Available(); n != 3 {
+		t.Errorf("available=%d when disabled, want 3", n)
+	}
+	w.SetEnabled(true)
+
+	// The tokens accrue while idle up to the burst size
+	time.Sleep(5 * delay)
+	if n := w.Available(); n != 3 {
+		t.Errorf("available=%d, want 3", n)
+	}
+	start := time.Now()
+	for range 3 {
+		w.Wait(nil)
+	}
+	if elapsed := time.Since(start); elapsed > delay {
+		t.Errorf("burst elapsed=%v, want less than %v", elapsed, delay)
+	}
+
+	// The Waiter without bursts allows one call
+	w2 := New(delay, 10)
+	defer w2.Close()
+	if n := w2.Available(); n != 0 {
+		t.Errorf("available=%d, want 0", n)
+	}
+	time.Sleep(delay)
+	if n := w2.Available(); n != 1 {
+		t.Errorf("available=%d, want 1", n)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	w := New(delay, 10)
+	defer w.Close()
+
+	// The slot is taken once per delay
+	time.Sleep(delay)
+	if !w.Allow() {
+		t.Error("allow=false after the delay, want true")
+	}
+	if w.Allow() {
+		t.Error("allow=true right after the allowed call, want false")
+	}
+	time.Sleep(delay / 2)
+	if w.Allow() {
+		t.Error("allow=true before the delay, want false")
+	}
+	time.Sleep(delay / 2)
+	if !w.Allow() {
+		t.Error("allow=false after the delay, want true")
+	}
+
+	// AllowN(0) takes nothing
+	time.Sleep(delay)
+	if !w.AllowN(0) {
+		t.Error("allowN(0)=false, want true")
+	}
+	if d := w.NextAllowed(); d != 0 {
+		t.Errorf("next allowed=%v after allowN(0), want 0", d)
+	}
+
+	// AllowN takes n delays since the last call
+	if w.AllowN(2) {
+		t.Error("allowN(2)=true after one delay, want false")
+	}
+	time.Sleep(delay)
+	if !w.AllowN(2) {
+		t.Error("allowN(2)=false after two delays, want true")
+	}
+
+	// The queued function waits the two delays since the allowed calls
+	start := time.Now()
+	w.Wait(nil)
+	if elapsed := time.Since(start); elapsed < 2*delay-5*time.Millisecond {
+		t.Errorf("elapsed=%v, want >= %v", elapsed, 2*delay)
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := NewBurst(delay, 10, 3)
+	defer w.Close()
+
+	// The burst allows three calls, then the tokens are refilled one per
+	// delay
+	if !w.AllowN(3) {
+		t.Error("allowN(3)=false with the full bucket, want true")
+	}
+	if w.Allow() {
+		t.Error("allow=true with the empty bucket, want false")
+	}
+	time.Sleep(2 * delay)
+	if w.AllowN(3) {
+		t.Error("allowN(3)=true with two tokens, want false")
+	}
+	if !w.AllowN(2) {
+		t.Error("allowN(2)=false with two tokens, want true")
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// Create Waiters with queued functions and pool workers and close them
+	for range 10 {
+		w := New(time.Second, 10)
+		w.Call(func() {})
+		w.Call(func() {})
+		p := NewPool(time.Second, 10, 3)
+		p.Call(func() {})
+		w.Close()
+		p.Close()
+		<-w.stopped
+		<-p.stopped
+	}
+
+	// All the worker goroutines exit after Close
+	var after int
+	for range 100 {
+		if after = runtime.NumGoroutine(); after <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("goroutines=%d after Close, want %d", after, before)
+}
+
+func TestNewUnbounded(t *testing.T) {
+	w := NewUnbounded(time.Second)
+	defer w.Close()
+
+	// The calls never block and the backlog grows
+	const n = 10000
+	for range n {
+		if err := w.TryCall(func() {}); err != nil {
+			t.Fatalf("call error: %v", err)
+		}
+	}
+	if l := w.Len(); l < n-1 {
+		t.Errorf("len=%d, want at least %d", l, n-1)
+	}
+}
+
+func TestSetGate(t *testing.T) {
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+
+	// The function is not called while the gate is closed
+	var open atomic.Bool
+	w.SetGate(open.Load)
+	var called atomic.Bool
+	w.Call(func() { called.Store(true) })
+	time.Sleep(50 * time.Millisecond)
+	if called.Load() {
+		t.Fatal("function is called while the gate is closed")
+	}
+
+	// The function is called after the gate opens
+	open.Store(true)
+	w.Flush()
+	if !called.Load() {
+		t.Error("function is not called after the gate opens")
+	}
+}
+
+func TestCloseInterruptsWait(t *testing.T) {
+	w := New(10*time.Second, 10)
+
+	// Close during the long delay stops the worker immediately
+	w.Call(func() {})
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	w.Close()
+	<-w.stopped
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("shutdown elapsed=%v, want immediate", elapsed)
+	}
+	if s := w.Stats(); s.Executed != 0 {
+		t.Errorf("executed=%d, want 0", s.Executed)
+	}
+}
+
+func TestCloseAndWaitTimeout(t *testing.T) {
+	w := New(time.Millisecond, 10)
+
+	// The slow function does not finish within the timeout
+	var rejected atomic.Int32
+	w.SetOnReject(func(fn func()) { rejected.Add(1) })
+	w.Call(func() { time.Sleep(100 * time.Millisecond) })
+	w.Call(func() {})
+	w.Call(func() {})
+	time.Sleep(10 * time.Millisecond)
+
+	err := w.CloseAndWaitTimeout(20 * time.Millisecond)
+	if !errors.Is(err, ErrDrainTimeout) {
+		t.Fatalf("err=%v, want %v", err, ErrDrainTimeout)
+	}
+	if want := "waiter drain timeout: 3 functions not called"; err.Error() != want {
+		t.Errorf("err=%q, want %q", err, want)
+	}
+
+	// The remaining functions are discarded
+	<-w.stopped
+	if n := rejected.Load(); n != 2 {
+		t.Errorf("rejected=%d, want 2", n)
+	}
+
+	// The fast queue is drained within the timeout
+	w = New(time.Millisecond, 10)
+	w.Call(func() {})
+	if err := w.CloseAndWaitTimeout(time.Second); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	const fast, slow = 10 * time.Millisecond, 30 * time.Millisecond
+	w1 := New(fast, 10)
+	w2 := New(slow, 10)
+	defer w1.Close()
+	defer w2.Close()
+	w := Chain(w1, w2)
+	defer w.Close()
+
+	// The burst of calls is spaced by the slower delay
+	var mu sync.Mutex
+	var times []time.Time
+	for range 5 {
+		w.Call(func() {
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+		})
+	}
+	w.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 5 {
+		t.Fatalf("calls=%d, want 5", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < slow*3/4 {
+			t.Errorf("gap %d=%v, want at least %v", i, gap, slow)
+		}
+	}
+}
+
+func TestChainClose(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	stage := New(delay, 10)
+	defer stage.Close()
+	start := time.Now()
+	w := Chain(stage)
+
+	// Close wakes up the worker waiting the turn in the slow stage
+	w.Call(func() {})
+	w.Call(func() {})
+	time.Sleep(10 * time.Millisecond)
+	closed := time.Now()
+	w.Close()
+	w.Flush()
+	<-w.stopped
+	if elapsed := time.Since(closed); elapsed > delay/2 {
+		t.Errorf("close elapsed=%v, want immediate", elapsed)
+	}
+
+	// The cancelled wait does not take the turn of the stage
+	stage.Wait(nil)
+	if elapsed := time.Since(start); elapsed > delay*3/2 {
+		t.Errorf("stage call elapsed=%v, want about %v", elapsed, delay)
+	}
+}
+
+func TestCallBy(t *testing.T) {
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+
+	// Block the worker until all the functions are added
+	release := make(chan struct{})
+	w.Call(func() { <-release })
+
+	var mu sync.Mutex
+	var order []int
+	now := time.Now()
+	for _, i := range []int{3, 1, 4, 2} {
+		w.CallBy(now.Add(time.Duration(i)*time.Second), func() {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+
+	// The expired function is skipped
+	w.CallBy(now.Add(-time.Second), func() {
+		mu.Lock()
+		order = append(order, 0)
+		mu.Unlock()
+	})
+	close(release)
+	w.Flush()
+
+	// The functions are called by deadline
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(order, []int{1, 2, 3, 4}) {
+		t.Errorf("order=%v, want [1 2 3 4]", order)
+	}
+}
+
+func TestWouldBlock(t *testing.T) {
+	w := New(time.Second, 2)
+	defer w.Close()
+
+	if w.WouldBlock() {
+		t.Error("empty queue would block")
+	}
+
+	// Fill the queue while the worker waits the delay
+	for w.TryCall(func() {}) == nil {
+	}
+	time.Sleep(10 * time.Millisecond)
+	for w.TryCall(func() {}) == nil {
+	}
+	if !w.WouldBlock() {
+		t.Error("full queue would not block")
+	}
+}
+
+func TestCallWeighted(t *testing.T) {
+	w := New(0, 200)
+	defer w.Close()
+
+	// Block the worker until all the functions are added
+	release := make(chan struct{})
+	w.Call(func() { <-release })
+
+	var mu sync.Mutex
+	var order []string
+	add := func(group string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, group)
+			mu.Unlock()
+		}
+	}
+	for range 60 {
+		w.CallWeighted("A", 3, add("A"))
+		w.CallWeighted("B", 1, add("B"))
+	}
+	close(release)
+	w.Flush()
+
+	// The first dispatches are shared 3:1 while both groups have functions
+	mu.Lock()
+	defer mu.Unlock()
+	a := 0
+	for _, group := range order[:40] {
+		if group == "A" {
+			a++
+		}
+	}
+	if a < 28 || a > 32 {
+		t.Errorf("A calls=%d of 40, want about 30", a)
+	}
+}
+
+func TestNewSync(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	w := NewSync(delay)
+
+	// The function is called before Call returns, after the delay
+	start := time.Now()
+	for range 3 {
+		var called bool
+		if err := w.Call(func() { called = true }); err != nil {
+			t.Fatalf("call error: %v", err)
+		}
+		if !called {
+			t.Fatal("function is not called synchronously")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("elapsed=%v, want at least %v", elapsed, 2*delay)
+	}
+
+	// The blocking functions work without the worker
+	if err := w.WaitTimeout(nil, time.Second); err != nil {
+		t.Errorf("wait error: %v", err)
+	}
+	if s := w.Stats(); s.Executed != 4 {
+		t.Errorf("executed=%d, want 4", s.Executed)
+	}
+
+	w.CloseAndWait()
+	if err := w.Call(func() {}); err != ErrWaiterClosed {
+		t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+}
+
+func TestNewSyncClose(t *testing.T) {
+	w := NewSync(300 * time.Millisecond)
+	w.Call(func() {})
+
+	// Close interrupts the blocked Call and the function is not called
+	var called atomic.Bool
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Call(func() { called.Store(true) }) }()
+	time.Sleep(50 * time.Millisecond)
+	w.Close()
+	select {
+	case err := <-errCh:
+		if err != ErrWaiterClosed {
+			t.Errorf("err=%v, want %v", err, ErrWaiterClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call is not released by Close")
+	}
+	if called.Load() {
+		t.Error("function is called after Close")
+	}
+}
+
+func BenchmarkCall(b *testing.B) {
+	b.Run("async", func(b *testing.B) {
+		w := New(0, 100)
+		defer w.Close()
+		for b.Loop() {
+			w.Call(func() {})
+		}
+		w.Flush()
+	})
+	b.Run("sync", func(b *testing.B) {
+		w := NewSync(0)
+		defer w.Close()
+		for b.Loop() {
+			w.Call(func() {})
+		}
+	})
+}
+
+func TestOnEmpty(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+
+	var calls, empty atomic.Int32
+	var callsAtEmpty atomic.Int32
+	w.OnEmpty(func() {
+		empty.Add(1)
+		callsAtEmpty.Store(calls.Load())
+	})
+
+	// The handler is called once after the third function
+	for range 3 {
+		w.Call(func() { calls.Add(1) })
+	}
+	w.Flush()
+	time.Sleep(10 * time.Millisecond)
+	if n := empty.Load(); n != 1 {
+		t.Errorf("empty=%d, want 1", n)
+	}
+	if n := callsAtEmpty.Load(); n != 3 {
+		t.Errorf("calls at empty=%d, want 3", n)
+	}
+
+	// The handler is called when the last pending function is cancelled
+	w.Call(func() { calls.Add(1) })
+	cancel, _ := w.CallCancelable(func() { calls.Add(1) })
+	cancel()
+	w.Flush()
+	time.Sleep(10 * time.Millisecond)
+	if n := empty.Load(); n != 2 {
+		t.Errorf("empty=%d, want 2", n)
+	}
+}
+
+func TestSetSchedule(t *testing.T) {
+	const short, long = 10 * time.Millisecond, 50 * time.Millisecond
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	// The schedule switches from the short to the long delay
+	switchAt := time.Now().Add(5 * short)
+	w.SetSchedule(func(now time.Time) time.Duration {
+		if now.Before(switchAt) {
+			return short
+		}
+		return long
+	})
+
+	var mu sync.Mutex
+	var times []time.Time
+	for range 8 {
+		w.Call(func() {
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+		})
+	}
+	w.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	first, last := times[1].Sub(times[0]), times[7].Sub(times[6])
+	if first > short*2 {
+		t.Errorf("first gap=%v, want about %v", first, short)
+	}
+	if last < long*3/4 {
+		t.Errorf("last gap=%v, want about %v", last, long)
+	}
+}
+
+func BenchmarkWait(b *testing.B) {
+	w := New(0, 100)
+	defer w.Close()
+	b.ReportAllocs()
+	for b.Loop() {
+		w.Wait(nil)
+	}
+}
+
+func TestSetCoalesce(t *testing.T) {
+	w := New(10*time.Millisecond, 10)
+	defer w.Close()
+	w.SetCoalesce(true)
+
+	// The duplicates added before the call are skipped
+	var calls atomic.Int32
+	for range 5 {
+		if err := w.CallKeyed("refresh", func() { calls.Add(1) }); err != nil {
+			t.Fatalf("call error: %v", err)
+		}
+	}
+	w.Flush()
+	if n := calls.Load(); n >= 5 || n < 1 {
+		t.Errorf("calls=%d, want from 1 to 4", n)
+	}
+
+	// The function added after the call is called
+	calls.Store(0)
+	w.CallKeyed("refresh", func() { calls.Add(1) })
+	w.Flush()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("calls=%d, want 1", n)
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	w := New(time.Second, 10)
+
+	// One function waits the delay in the worker and three are queued
+	for range 4 {
+		w.Call(func() {})
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := w.Close(); err != nil {
+		t.Fatalf("first close err=%v, want nil", err)
+	}
+
+	// The second Close reports the discarded functions
+	err := w.Close()
+	if !errors.Is(err, ErrWaiterClosed) {
+		t.Fatalf("err=%v, want %v", err, ErrWaiterClosed)
+	}
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("err=%T, want *CloseError", err)
+	}
+	if closeErr.Queued != 3 {
+		t.Errorf("queued=%d, want 3", closeErr.Queued)
+	}
+	if want := "waiter is closed: 3 queued functions discarded"; err.Error() != want {
+		t.Errorf("err=%q, want %q", err, want)
+	}
+}
+
+func TestCallLimited(t *testing.T) {
+	w := New(time.Millisecond, 10)
+	defer w.Close()
+	l := &testLogger{}
+	w.SetLogger(l)
+
+	// The hung function is abandoned and the next function is still called
+	release := make(chan struct{})
+	defer close(release)
+	if err := w.CallLimited(20*time.Millisecond, func() { <-release }); err != nil {
+		t.Fatal(err)
+	}
+	called := make(chan struct{})
+	w.Call(func() { close(called) })
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("the next function was not called after the exec timeout")
+	}
+
+	l.mu.Lock()
+	log := strings.Join(l.msgs, "\n")
+	l.mu.Unlock()
+	if want := "function abandoned after 20ms"; !strings.Contains(log, want) {
+		t.Errorf("log %q does not contain %q", log, want)
+	}
+
+	// The function which returns in time is waited for
+	var n atomic.Int32
+	w.CallLimited(time.Second, func() {
+		time.Sleep(10 * time.Millisecond)
+		n.Add(1)
+	})
+	w.Flush()
+	if n.Load() != 1 {
+		t.Errorf("calls=%d, want 1 after Flush", n.Load())
+	}
+}
+
+func TestPending(t *testing.T) {
+	w := New(time.Second, 10)
+	defer w.Close()
+
+	// The first function waits the delay in the worker and is not pending
+	w.CallLabeled("first", func() {})
+	time.Sleep(10 * time.Millisecond)
+	for _, label := range []string{"a", "b", "c"} {
+		if err := w.CallLabeled(label, func() {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Call(func() {})
+
+	if got, want := w.Pending(), []string{"a", "b", "c", ""}; !slices.Equal(got, want) {
+		t.Errorf("pending=%q, want %q", got, want)
+	}
+}
+
+func TestPendingLabelsFreed(t *testing.T) {
+	w := New(0, 1000)
+	defer w.Close()
+
+	// Enqueue and drain many distinct labels
+	for i := range 1000 {
+		w.CallLabeled(fmt.Sprintf("label-%d", i), func() {})
+	}
+	w.Flush()
+	if p := w.Pending(); len(p) != 0 {
+		t.Errorf("pending=%d after flush, want 0", len(p))
+	}
+
+	// No label is retained by the queue after the tasks are dequeued
+	w.q.mu.Lock()
+	for i, tk := range w.q.tasks[:cap(w.q.tasks)] {
+		if tk.label != "" {
+			t.Errorf("task %d label=%q is retained", i, tk.label)
+			break
+		}
+	}
+	w.q.mu.Unlock()
+
+	// The long label is truncated at the rune boundary
+	long := strings.Repeat("a", maxLabelLen-1) + "ж" + strings.Repeat("b", 100)
+	if got := truncateLabel(long); got != strings.Repeat("a", maxLabelLen-1) {
+		t.Errorf("label length=%d, want %d", len(got), maxLabelLen-1)
+	}
+	if got := truncateLabel("short"); got != "short" {
+		t.Errorf("label=%q, want short", got)
+	}
+}